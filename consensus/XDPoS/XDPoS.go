@@ -21,14 +21,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"math/big"
 	"math/rand"
-	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/accounts"
@@ -50,8 +50,12 @@ import (
 )
 
 const (
-	inmemorySnapshots      = 128 // Number of recent vote snapshots to keep in memory
+	inmemorySnapshots      = 128  // Number of recent vote snapshots to keep in memory
+	inmemoryDifficulties   = 1024 // Number of recent parents to keep difficulties of in memory
 	blockSignersCacheLimit = 9000
+	maxProposals           = 256  // Default number of proposals the signer pushes at most
+	rewardQueueSize        = 64   // Default number of reward maps queued for saving
+	maxProducersRange      = 4096 // Maximum number of blocks whose producers are collected at once
 	M2ByteLength           = 4
 )
 
@@ -60,10 +64,19 @@ type Masternode struct {
 	Stake   *big.Int
 }
 
+// VoteRecord is a single vote cast on a candidate by the creator of a block.
+type VoteRecord struct {
+	Block     uint64         `json:"block"`     // Block number the vote was cast in
+	Signer    common.Address `json:"signer"`    // Creator of the block casting the vote
+	Authorize bool           `json:"authorize"` // Whether to authorize or deauthorize the candidate
+}
+
 // XDPoS proof-of-stake-voting protocol constants.
 var (
 	epochLength = uint64(900) // Default number of blocks after which to checkpoint and reset the pending votes
 
+	recentSignerLimit = uint64(2) // Default number of consecutive blocks a masternode may sign only one of
+
 	extraVanity = 32 // Fixed number of extra-data prefix bytes reserved for signer vanity
 	extraSeal   = 65 // Fixed number of extra-data suffix bytes reserved for signer seal
 
@@ -86,7 +99,7 @@ var (
 	errUnknownBlock = errors.New("unknown block")
 
 	// errInvalidCheckpointBeneficiary is returned if a checkpoint/epoch transition
-	// block has a beneficiary set to non-zeroes.
+	// block has a beneficiary set to non-zeroes without a vote nonce.
 	errInvalidCheckpointBeneficiary = errors.New("beneficiary in checkpoint block non-zero")
 
 	// errInvalidVote is returned if a nonce value is something else that the two
@@ -145,6 +158,91 @@ var (
 	errWaitTransactions = errors.New("waiting for transactions")
 
 	ErrInvalidCheckpointValidators = errors.New("invalid validators list on checkpoint block")
+
+	// ErrMissingValidators is returned if a checkpoint block past the first epoch
+	// doesn't carry a validator for each of its masternodes once required by the
+	// checkpoint validators fork, or carries a list of another size.
+	ErrMissingValidators = errors.New("missing validators on checkpoint block")
+
+	// ErrEmptyCheckpointSigners is returned if a checkpoint block doesn't contain
+	// any masternode while the engine isn't bootstrapping.
+	ErrEmptyCheckpointSigners = errors.New("empty signer list on checkpoint block")
+
+	// ErrNonContiguousBatch is returned if a batch of headers to verify is not in
+	// ascending order or doesn't link up by parent hashes.
+	ErrNonContiguousBatch = errors.New("non contiguous header batch")
+
+	// ErrValidatorNotMasternode is returned if the validator of a block is not a
+	// masternode of the epoch.
+	ErrValidatorNotMasternode = errors.New("validator is not a masternode")
+
+	// ErrMissingSigningTx is returned if a reward checkpoint block doesn't include
+	// an expected signing transaction, or if it failed.
+	ErrMissingSigningTx = errors.New("missing signing transaction at reward checkpoint")
+
+	// errSlotPassed is returned if a block is attempted to be produced after its
+	// time slot has passed while the block time is strictly enforced.
+	errSlotPassed = errors.New("block time slot passed")
+
+	// errNoMasternodes is returned if the set of masternodes allowed to seal the
+	// next block is empty.
+	errNoMasternodes = errors.New("Masternodes not found")
+
+	// errNoProducer is returned if every masternode is excluded from sealing the
+	// next block.
+	errNoProducer = errors.New("no masternode allowed to seal")
+
+	// errBlockSignersMismatch is returned if the cached signing transactions of a
+	// block are not part of the block.
+	errBlockSignersMismatch = errors.New("block signers cache mismatch")
+
+	// errTooManyProposals is returned if a new proposal is attempted to be added
+	// while the signer is already pushing the maximum number of proposals.
+	errTooManyProposals = errors.New("too many proposals")
+
+	// ErrCheckpointVoteConflict is returned if a checkpoint block casts a vote by
+	// both a non-zero beneficiary and a vote nonce.
+	ErrCheckpointVoteConflict = errors.New("vote cast on checkpoint block")
+
+	// errNoSigner is returned if the local signer is checked before any signer
+	// was authorized.
+	errNoSigner = errors.New("no signer authorized")
+
+	// errNoSignFn is returned if the local signer is authorized without a signing
+	// function.
+	errNoSignFn = errors.New("missing sign function")
+
+	// ErrExcessivePenalties is returned if a checkpoint block penalises a larger
+	// share of the masternodes than allowed.
+	ErrExcessivePenalties = errors.New("too many penalties on checkpoint block")
+
+	// ErrPenaltyOfNonMember is returned if a checkpoint block penalises an address
+	// which was not a masternode eligible to be penalised.
+	ErrPenaltyOfNonMember = errors.New("penalty of non-masternode on checkpoint block")
+
+	// ErrMissingGapHeader is returned if a header of the gap preceding a checkpoint
+	// block, where the masternodes are read from the contract, isn't available.
+	ErrMissingGapHeader = errors.New("missing gap header")
+
+	// ErrMissingCheckpointHeader is returned if the checkpoint block governing a
+	// block isn't available.
+	ErrMissingCheckpointHeader = errors.New("missing checkpoint header")
+
+	// ErrNoValidatorBeforeFirstEpoch is returned when looking up the validator of
+	// a block of the first epoch, which is produced without double validation.
+	ErrNoValidatorBeforeFirstEpoch = errors.New("no validator before the first epoch")
+
+	// ErrEpochTimingDeviation is returned if the time spanned by the blocks of an
+	// epoch deviates from the one expected from the block period.
+	ErrEpochTimingDeviation = errors.New("epoch timing deviates from block period")
+
+	// ErrGovernanceSetMismatch is returned if the masternodes of a checkpoint block
+	// differ from the ones resulting from the governance events.
+	ErrGovernanceSetMismatch = errors.New("masternodes mismatch governance events")
+
+	// errRangeTooLarge is returned if the producers of more blocks than allowed
+	// are requested at once.
+	errRangeTooLarge = errors.New("block range too large")
 )
 
 // SignerFn is a signer callback function to request a hash to be signed by a
@@ -161,7 +259,15 @@ var (
 func sigHash(header *types.Header) (hash common.Hash) {
 	hasher := sha3.NewKeccak256()
 
-	rlp.Encode(hasher, []interface{}{
+	rlp.Encode(hasher, sigFields(header))
+	hasher.Sum(hash[:0])
+	return hash
+}
+
+// sigFields returns the header fields covered by the seal signature, i.e. all
+// of them apart from the 65 byte signature at the end of the extra data.
+func sigFields(header *types.Header) []interface{} {
+	return []interface{}{
 		header.ParentHash,
 		header.UncleHash,
 		header.Coinbase,
@@ -177,17 +283,30 @@ func sigHash(header *types.Header) (hash common.Hash) {
 		header.Extra[:len(header.Extra)-65], // Yes, this will panic if extra is too short
 		header.MixDigest,
 		header.Nonce,
-	})
-	hasher.Sum(hash[:0])
-	return hash
+	}
 }
 
 func SigHash(header *types.Header) (hash common.Hash) {
 	return sigHash(header)
 }
 
+// SigningPayload returns the hash which is signed to seal the header together
+// with its RLP preimage, so that an external signer can verify independently
+// what it is about to sign. Unlike SigHash, it doesn't panic on a too short
+// extra data but returns an error instead.
+func SigningPayload(header *types.Header) (common.Hash, []byte, error) {
+	if len(header.Extra) < extraSeal {
+		return common.Hash{}, nil, errMissingSignature
+	}
+	preimage, err := rlp.EncodeToBytes(sigFields(header))
+	if err != nil {
+		return common.Hash{}, nil, err
+	}
+	return crypto.Keccak256Hash(preimage), preimage, nil
+}
+
 // ecrecover extracts the Ethereum account address from a signed header.
-func ecrecover(header *types.Header, sigcache *lru.ARCCache) (common.Address, error) {
+func ecrecover(header *types.Header, sigcache *countingCache) (common.Address, error) {
 	// If the signature's already cached, return that
 	hash := header.Hash()
 	if address, known := sigcache.Get(hash); known {
@@ -217,47 +336,107 @@ type XDPoS struct {
 	config *params.XDPoSConfig // Consensus engine configuration parameters
 	db     ethdb.Database     // Database to store and retrieve snapshot checkpoints
 
-	recents             *lru.ARCCache // Snapshots for recent block to speed up reorgs
-	signatures          *lru.ARCCache // Signatures of recent blocks to speed up mining
-	validatorSignatures *lru.ARCCache // Signatures of recent blocks to speed up mining
+	sealPeriod      uint64 // Block period used when producing blocks, raised by ReloadConfig
+	sealSignerLimit uint64 // Recent signer limit used when sealing blocks, raised by ReloadConfig
+
+	snapshots SnapshotStore // Backend persisting the checkpoint snapshots
+
+	recents             *countingCache // Snapshots for recent block to speed up reorgs
+	signatures          *countingCache // Signatures of recent blocks to speed up mining
+	validatorSignatures *lru.ARCCache  // Signatures of recent blocks to speed up mining
 	verifiedHeaders     *lru.ARCCache
+	difficulties        *lru.ARCCache           // Difficulties on top of recent parents to speed up verification and mining
 	proposals           map[common.Address]bool // Current list of proposals we are pushing
+	counters            *engineCounters         // Activity counters reported by EngineMetrics
+	verifyErrors        *verifyErrorRing        // Recent header verification failures reported by RecentVerifyErrors
+	rewards             *rewardWriter           // Background writer of the reward maps
 
 	signer common.Address  // Ethereum address of the signing key
 	signFn clique.SignerFn // Signer function to authorize hashes with
 	lock   sync.RWMutex    // Protects the signer fields
 
-	BlockSigners          *lru.Cache
-	HookReward            func(chain consensus.ChainReader, state *state.StateDB, header *types.Header) (error, map[string]interface{})
-	HookPenalty           func(chain consensus.ChainReader, blockNumberEpoc uint64) ([]common.Address, error)
-	HookPenaltyTIPSigning func(chain consensus.ChainReader, header *types.Header, candidate []common.Address) ([]common.Address, error)
-	HookValidator         func(header *types.Header, signers []common.Address) ([]byte, error)
-	HookVerifyMNs         func(header *types.Header, signers []common.Address) error
+	BlockSigners               *lru.Cache
+	HookReward                 func(chain consensus.ChainReader, state *state.StateDB, header *types.Header) (error, map[string]interface{})
+	HookPenalty                func(chain consensus.ChainReader, blockNumberEpoc uint64) ([]common.Address, error)
+	HookPenaltyTIPSigning      func(chain consensus.ChainReader, header *types.Header, candidate []common.Address) ([]common.Address, error)
+	HookValidator              func(header *types.Header, signers []common.Address) ([]byte, error)
+	HookVerifyMNs              func(header *types.Header, signers []common.Address) error
+	HookSyncing                func() bool
+	HookGetSignersFromContract func(block common.Hash) ([]common.Address, error)
+	OnMasternodeSetChange      func(old, new []common.Address) // Notified with the previous and new masternodes once UpdateMasternodes succeeds
+
+	Bootstrap       bool // Accept checkpoint blocks without masternodes while bootstrapping a network
+	MaxProposals    int  // Maximum number of proposals the signer is pushing at once
+	LogMasternodes  bool // Log the full masternode set of each new epoch when preparing checkpoints
+	StrictBlockTime bool // Refuse to produce blocks once their slot has passed instead of catching up
+	RewardQueueSize int  // Number of reward maps queued for saving before Finalize blocks
+
+	StructuralGenesis  bool   // Only check the structure of the genesis extra-data instead of fully verifying it
+	MaxPenaltyPercent  uint64 // Maximum share of the masternodes a checkpoint may penalise, in percent (0 = unbounded)
+	DiagnoseDifficulty bool   // Log the breakdown of the expected difficulty when a block's one mismatches
+
+	EmergencyMasternodes []common.Address // Masternodes producing blocks if none are found, otherwise production halts
+
+	IsSigningTx func(tx *types.Transaction) bool // Recognizes the transactions of the block signing contract
+
+	FutureBlockTolerance     time.Duration // Allowed clock drift of headers received live
+	SyncFutureBlockTolerance time.Duration // Allowed clock drift of headers imported while syncing
 }
 
 // New creates a XDPoS proof-of-stake-voting consensus engine with the initial
 // signers set to the ones provided by the user.
 func New(config *params.XDPoSConfig, db ethdb.Database) *XDPoS {
+	return NewWithSnapshotStore(config, db, NewDBSnapshotStore(db))
+}
+
+// NewWithSignatureCache creates a XDPoS consensus engine recovering the block
+// signers through the given signature cache, so that engines running side by
+// side don't recover the same signatures twice. A nil cache keeps it private.
+func NewWithSignatureCache(config *params.XDPoSConfig, db ethdb.Database, signatures *lru.ARCCache) *XDPoS {
+	c := New(config, db)
+	if signatures != nil {
+		c.signatures = &countingCache{ARCCache: signatures}
+	}
+	return c
+}
+
+// NewWithSnapshotStore creates a XDPoS consensus engine persisting its snapshots
+// into a store separate from the chain database.
+func NewWithSnapshotStore(config *params.XDPoSConfig, db ethdb.Database, snapshots SnapshotStore) *XDPoS {
 	// Set any missing consensus parameters to their defaults
 	conf := *config
 	if conf.Epoch == 0 {
 		conf.Epoch = epochLength
 	}
+	if conf.RecentSignerLimit == 0 {
+		conf.RecentSignerLimit = recentSignerLimit
+	}
 	// Allocate the snapshot caches and create the engine
 	BlockSigners, _ := lru.New(blockSignersCacheLimit)
-	recents, _ := lru.NewARC(inmemorySnapshots)
-	signatures, _ := lru.NewARC(inmemorySnapshots)
+	recents := newCountingCache(inmemorySnapshots)
+	signatures := newCountingCache(inmemorySnapshots)
 	validatorSignatures, _ := lru.NewARC(inmemorySnapshots)
 	verifiedHeaders, _ := lru.NewARC(inmemorySnapshots)
+	difficulties, _ := lru.NewARC(inmemoryDifficulties)
 	return &XDPoS{
 		config:              &conf,
 		db:                  db,
+		sealPeriod:          conf.Period,
+		sealSignerLimit:     conf.RecentSignerLimit,
+		snapshots:           snapshots,
 		BlockSigners:        BlockSigners,
 		recents:             recents,
 		signatures:          signatures,
 		verifiedHeaders:     verifiedHeaders,
+		difficulties:        difficulties,
 		validatorSignatures: validatorSignatures,
 		proposals:           make(map[common.Address]bool),
+		counters:            new(engineCounters),
+		verifyErrors:        new(verifyErrorRing),
+		MaxProposals:        maxProposals,
+		rewards:             newRewardWriter(),
+		IsSigningTx:         (*types.Transaction).IsSigningTransaction,
+		RewardQueueSize:     rewardQueueSize,
 	}
 }
 
@@ -267,6 +446,38 @@ func (c *XDPoS) Author(header *types.Header) (common.Address, error) {
 	return ecrecover(header, c.signatures)
 }
 
+// AuthorBatch recovers the addresses which minted the given headers, using a
+// bounded number of concurrent workers. The results and errors are reported per
+// header, in the order of the input slice.
+func (c *XDPoS) AuthorBatch(headers []*types.Header) ([]common.Address, []error) {
+	var (
+		authors = make([]common.Address, len(headers))
+		errs    = make([]error, len(headers))
+		jobs    = make(chan int)
+		wg      sync.WaitGroup
+	)
+	workers := runtime.NumCPU()
+	if workers > len(headers) {
+		workers = len(headers)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				authors[index], errs[index] = ecrecover(headers[index], c.signatures)
+			}
+		}()
+	}
+	for i := range headers {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return authors, errs
+}
+
 // VerifyHeader checks whether a header conforms to the consensus rules.
 func (c *XDPoS) VerifyHeader(chain consensus.ChainReader, header *types.Header, fullVerify bool) error {
 	return c.verifyHeaderWithCache(chain, header, nil, fullVerify)
@@ -279,9 +490,22 @@ func (c *XDPoS) VerifyHeaders(chain consensus.ChainReader, headers []*types.Head
 	abort := make(chan struct{})
 	results := make(chan error, len(headers))
 
+	// Headers are verified against the preceding ones in the batch, so anything
+	// from the first gap onwards can't be verified meaningfully
+	contiguous := len(headers)
+	for i := 1; i < len(headers); i++ {
+		if headers[i].Number == nil || headers[i-1].Number == nil ||
+			headers[i].Number.Uint64() != headers[i-1].Number.Uint64()+1 || headers[i].ParentHash != headers[i-1].Hash() {
+			contiguous = i
+			break
+		}
+	}
 	go func() {
 		for i, header := range headers {
-			err := c.verifyHeaderWithCache(chain, header, headers[:i], fullVerifies[i])
+			err := ErrNonContiguousBatch
+			if i < contiguous {
+				err = c.verifyHeaderWithCache(chain, header, headers[:i], fullVerifies[i])
+			}
 
 			select {
 			case <-abort:
@@ -300,11 +524,33 @@ func (c *XDPoS) verifyHeaderWithCache(chain consensus.ChainReader, header *types
 	}
 	err := c.verifyHeader(chain, header, parents, fullVerify)
 	if err == nil {
-		c.verifiedHeaders.Add(header.Hash(), true)
+		c.verifiedHeaders.Add(header.Hash(), header.Number.Uint64())
+		atomic.AddUint64(&c.counters.headersVerified, 1)
+	} else if header.Number != nil {
+		c.verifyErrors.add(VerifyErrorRecord{Number: header.Number.Uint64(), Hash: header.Hash(), Error: err.Error()})
 	}
 	return err
 }
 
+// InvalidateVerifiedHeader drops a header from the verified headers cache, so
+// that it's verified again if encountered anew, like after being orphaned.
+func (c *XDPoS) InvalidateVerifiedHeader(hash common.Hash) {
+	c.verifiedHeaders.Remove(hash)
+}
+
+// PruneVerifiedHeaders drops the verified headers below the given horizon from
+// the cache. Code deleting headers from the database must call it with the
+// lowest block number it keeps: the headers above deleted ancestors couldn't be
+// verified again once evicted, so they mustn't be served from the cache either.
+// Nothing in the node itself deletes headers at the moment.
+func (c *XDPoS) PruneVerifiedHeaders(horizon uint64) {
+	for _, hash := range c.verifiedHeaders.Keys() {
+		if number, ok := c.verifiedHeaders.Peek(hash); ok && number.(uint64) < horizon {
+			c.verifiedHeaders.Remove(hash)
+		}
+	}
+}
+
 // verifyHeader checks whether a header conforms to the consensus rules.The
 // caller may optionally pass in a batch of parents (ascending order) to avoid
 // looking those up from the database. This is useful for concurrently verifying
@@ -318,17 +564,22 @@ func (c *XDPoS) verifyHeader(chain consensus.ChainReader, header *types.Header,
 	}
 	number := header.Number.Uint64()
 	if fullVerify {
-		if header.Number.Uint64() > c.config.Epoch && len(header.Validator) == 0 {
+		if c.isDoubleValidated(number) && len(header.Validator) == 0 {
 			return consensus.ErrNoValidatorSignature
 		}
 		// Don't waste time checking blocks from the future
-		if header.Time.Cmp(big.NewInt(time.Now().Unix())) > 0 {
+		if header.Time.Cmp(big.NewInt(time.Now().Add(c.futureBlockTolerance()).Unix())) > 0 {
 			return consensus.ErrFutureBlock
 		}
 	}
-	// Checkpoint blocks need to enforce zero beneficiary
+	// Checkpoint blocks need to enforce zero beneficiary. Along with a vote nonce
+	// the beneficiary casts a vote, which checkpoints don't allow, otherwise the
+	// beneficiary alone is invalid.
 	checkpoint := (number % c.config.Epoch) == 0
 	if checkpoint && header.Coinbase != (common.Address{}) {
+		if bytes.Equal(header.Nonce[:], nonceAuthVote) || bytes.Equal(header.Nonce[:], nonceDropVote) {
+			return ErrCheckpointVoteConflict
+		}
 		return errInvalidCheckpointBeneficiary
 	}
 
@@ -354,6 +605,9 @@ func (c *XDPoS) verifyHeader(chain consensus.ChainReader, header *types.Header,
 	if checkpoint && signersBytes%common.AddressLength != 0 {
 		return errInvalidCheckpointSigners
 	}
+	if checkpoint && signersBytes == 0 && !c.Bootstrap {
+		return ErrEmptyCheckpointSigners
+	}
 	// Ensure that the mix digest is zero as we don't have fork protection currently
 	if header.MixDigest != (common.Hash{}) {
 		return errInvalidMixDigest
@@ -370,6 +624,15 @@ func (c *XDPoS) verifyHeader(chain consensus.ChainReader, header *types.Header,
 	return c.verifyCascadingFields(chain, header, parents, fullVerify)
 }
 
+// futureBlockTolerance returns how far in the future the timestamp of a header
+// may be, depending on whether it is imported by a sync or received live.
+func (c *XDPoS) futureBlockTolerance() time.Duration {
+	if c.HookSyncing != nil && c.HookSyncing() {
+		return c.SyncFutureBlockTolerance
+	}
+	return c.FutureBlockTolerance
+}
+
 // verifyCascadingFields verifies all the header fields that are not standalone,
 // rather depend on a batch of previous headers. The caller may optionally pass
 // in a batch of parents (ascending order) to avoid looking those up from the
@@ -390,7 +653,7 @@ func (c *XDPoS) verifyCascadingFields(chain consensus.ChainReader, header *types
 	if parent == nil || parent.Number.Uint64() != number-1 || parent.Hash() != header.ParentHash {
 		return consensus.ErrUnknownAncestor
 	}
-	if parent.Time.Uint64()+c.config.Period > header.Time.Uint64() {
+	if parent.Time.Uint64()+c.GetPeriod() > header.Time.Uint64() {
 		return ErrInvalidTimestamp
 	}
 	// Retrieve the snapshot needed to verify this header and cache it
@@ -398,41 +661,63 @@ func (c *XDPoS) verifyCascadingFields(chain consensus.ChainReader, header *types
 	if err != nil {
 		return err
 	}
+	if snap.Number != parent.Number.Uint64() || snap.Hash != parent.Hash() {
+		// A stale cache entry supplied a snapshot of another block, drop it and
+		// derive the snapshot of the parent again
+		log.Warn("Snapshot inconsistent with parent header", "number", number, "parent", parent.Hash(), "snapNumber", snap.Number, "snapHash", snap.Hash)
+		c.recents.Remove(header.ParentHash)
+		if snap, err = c.snapshot(chain, number-1, header.ParentHash, parents); err != nil {
+			return err
+		}
+	}
 	// If the block is a checkpoint block, verify the signer list
 	if number%c.config.Epoch == 0 {
 		signers := snap.GetSigners()
-		penPenalties := []common.Address{}
-		if c.HookPenalty != nil || c.HookPenaltyTIPSigning != nil {
-			var err error = nil
-			if chain.Config().IsTIPSigning(header.Number) {
-				penPenalties, err = c.HookPenaltyTIPSigning(chain, header, signers)
-			} else {
-				penPenalties, err = c.HookPenalty(chain, number)
+		if penalties := common.ExtractAddressFromBytes(header.Penalties); len(penalties) > 0 {
+			if err := verifyPenaltiesSubset(penalties, c.penaltyEligible(chain, number, parents, signers)); err != nil {
+				log.Error("Checkpoint header penalises a non-masternode", "number", number, "penalties", penalties)
+				return err
 			}
+			if c.MaxPenaltyPercent > 0 && uint64(len(penalties))*100 > c.MaxPenaltyPercent*uint64(len(signers)) {
+				log.Error("Checkpoint header penalises too many masternodes", "number", number, "penalties", len(penalties), "masternodes", len(signers))
+				return ErrExcessivePenalties
+			}
+		}
+		penPenalties := []common.Address{}
+		if hook := c.penaltyHook(chain, header); hook != nil {
+			penPenalties, err = hook(chain, header, signers)
 			if err != nil {
 				return err
 			}
 			for _, address := range penPenalties {
 				log.Debug("Penalty Info", "address", address, "number", number)
 			}
-			bytePenalties := common.ExtractAddressToBytes(penPenalties)
-			if !bytes.Equal(header.Penalties, bytePenalties) {
+			// Penalties are encoded in ascending order, but blocks encoded in the
+			// order of the hook are still valid so compare them as sets
+			if len(header.Penalties)%common.AddressLength != 0 || !compareSignersLists(common.ExtractAddressFromBytes(header.Penalties), sortAddresses(penPenalties)) {
 				return errInvalidCheckpointPenalties
 			}
 		}
 		signers = common.RemoveItemFromArray(signers, penPenalties)
-		for i := 1; i <= common.LimitPenaltyEpoch; i++ {
-			if number > uint64(i)*c.config.Epoch {
-				signers = RemovePenaltiesFromBlock(chain, signers, number-uint64(i)*c.config.Epoch)
-			}
-		}
+		signers = c.removeRecentPenalties(chain, signers, number)
 		extraSuffix := len(header.Extra) - extraSeal
 		masternodesFromCheckpointHeader := common.ExtractAddressFromBytes(header.Extra[extraVanity:extraSuffix])
+		// Past the shuffle fork the order of the masternodes is part of consensus
+		if chain.Config().IsShuffleMasternodes(header.Number) && !reflect.DeepEqual(masternodesFromCheckpointHeader, shuffleMasternodes(signers, header.ParentHash)) {
+			log.Error("Masternodes order in checkpoint header isn't the shuffled one", "number", number, "masternodes_from_checkpoint_header", masternodesFromCheckpointHeader)
+			return errInvalidCheckpointSigners
+		}
 		validSigners := compareSignersLists(masternodesFromCheckpointHeader, signers)
 		if !validSigners {
 			log.Error("Masternodes lists are different in checkpoint header and snapshot", "number", number, "masternodes_from_checkpoint_header", masternodesFromCheckpointHeader, "masternodes_in_snapshot", signers, "penList", penPenalties)
 			return errInvalidCheckpointSigners
 		}
+		// Checkpoints past the first epoch assign a validator to each masternode,
+		// which was only optional for the checkpoints preceding the fork
+		if number >= c.config.Epoch && chain.Config().IsCheckpointValidators(header.Number) && len(header.Validators) != len(masternodesFromCheckpointHeader)*M2ByteLength {
+			log.Error("Validators list doesn't match masternodes in checkpoint header", "number", number, "masternodes", len(masternodesFromCheckpointHeader), "validators", len(header.Validators))
+			return ErrMissingValidators
+		}
 		if c.HookVerifyMNs != nil {
 			err := c.HookVerifyMNs(header, signers)
 			if err != nil {
@@ -444,6 +729,98 @@ func (c *XDPoS) verifyCascadingFields(chain consensus.ChainReader, header *types
 	return c.verifySeal(chain, header, parents, fullVerify)
 }
 
+// CheckpointExtraReport is a breakdown of the consensus fields of a checkpoint.
+type CheckpointExtraReport struct {
+	VanityBytes     int  `json:"vanityBytes"`     // Length of the vanity prefix of the extra-data
+	MasternodeCount int  `json:"masternodeCount"` // Number of masternodes listed in the extra-data
+	SealPresent     bool `json:"sealPresent"`     // Whether the extra-data ends with a non-empty seal
+	ValidatorsCount int  `json:"validatorsCount"` // Number of validators assigned to the masternodes
+	PenaltiesCount  int  `json:"penaltiesCount"`  // Number of masternodes penalised
+}
+
+// ValidateCheckpointExtra breaks down the consensus fields of a checkpoint
+// header and checks their structure, without looking at the chain. As whether
+// validators are required depends on the fork rules of the chain, only lists of
+// validators not matching the masternodes are reported. The report is filled as
+// far as the structure allows even if an error is returned.
+func (c *XDPoS) ValidateCheckpointExtra(header *types.Header) (*CheckpointExtraReport, error) {
+	report := new(CheckpointExtraReport)
+	number := header.Number.Uint64()
+	if number%c.config.Epoch != 0 {
+		return report, fmt.Errorf("block %d is not a checkpoint", number)
+	}
+	if len(header.Extra) < extraVanity {
+		report.VanityBytes = len(header.Extra)
+		return report, errMissingVanity
+	}
+	report.VanityBytes = extraVanity
+	if len(header.Extra) < extraVanity+extraSeal {
+		return report, errMissingSignature
+	}
+	report.SealPresent = !bytes.Equal(header.Extra[len(header.Extra)-extraSeal:], make([]byte, extraSeal))
+
+	signersBytes := len(header.Extra) - extraVanity - extraSeal
+	report.MasternodeCount = signersBytes / common.AddressLength
+	report.ValidatorsCount = len(header.Validators) / M2ByteLength
+	report.PenaltiesCount = len(header.Penalties) / common.AddressLength
+
+	switch {
+	case signersBytes%common.AddressLength != 0:
+		return report, errInvalidCheckpointSigners
+	case len(header.Penalties)%common.AddressLength != 0:
+		return report, errInvalidCheckpointPenalties
+	case len(header.Validators)%M2ByteLength != 0:
+		return report, ErrInvalidCheckpointValidators
+	case number >= c.config.Epoch && report.ValidatorsCount > 0 && report.ValidatorsCount != report.MasternodeCount:
+		return report, ErrMissingValidators
+	}
+	return report, nil
+}
+
+// penaltyEligible returns the addresses the checkpoint with the given number
+// may penalise: the signers of the snapshot, the masternodes of the previous
+// checkpoint, and the candidates coming back from the penalties carried by the
+// checkpoint LimitPenaltyEpoch+1 epochs earlier, which are checked again.
+func (c *XDPoS) penaltyEligible(chain consensus.ChainReader, number uint64, parents []*types.Header, signers []common.Address) []common.Address {
+	eligible := append([]common.Address{}, signers...)
+	if number > c.config.Epoch {
+		prevCheckpoint := findHeaderByNumber(chain, number-c.config.Epoch, parents)
+		eligible = append(eligible, c.GetMasternodesFromCheckpointHeader(prevCheckpoint, number, c.config.Epoch)...)
+	}
+	if comeback := (common.LimitPenaltyEpoch + 1) * c.config.Epoch; number > comeback {
+		if header := findHeaderByNumber(chain, number-comeback, parents); header != nil {
+			eligible = append(eligible, common.ExtractAddressFromBytes(header.Penalties)...)
+		}
+	}
+	return eligible
+}
+
+// verifyPenaltiesSubset checks that every penalised address is a member of the
+// given set of masternodes eligible to be penalised.
+func verifyPenaltiesSubset(penalties []common.Address, eligible []common.Address) error {
+	members := make(map[common.Address]struct{}, len(eligible))
+	for _, m := range eligible {
+		members[m] = struct{}{}
+	}
+	for _, p := range penalties {
+		if _, ok := members[p]; !ok {
+			return ErrPenaltyOfNonMember
+		}
+	}
+	return nil
+}
+
+// findHeaderByNumber looks up a header by number, preferring the batch of
+// parents (ascending order) that may not be part of the local chain yet.
+func findHeaderByNumber(chain consensus.ChainReader, number uint64, parents []*types.Header) *types.Header {
+	for i := len(parents) - 1; i >= 0; i-- {
+		if parents[i].Number.Uint64() == number {
+			return parents[i]
+		}
+	}
+	return chain.GetHeaderByNumber(number)
+}
+
 // compare 2 signers lists
 // return true if they are same elements, otherwise return false
 func compareSignersLists(list1 []common.Address, list2 []common.Address) bool {
@@ -470,7 +847,20 @@ func (c *XDPoS) GetSnapshot(chain consensus.ChainReader, header *types.Header) (
 }
 
 func (c *XDPoS) StoreSnapshot(snap *Snapshot) error {
-	return snap.store(c.db)
+	return snap.store(c.snapshots)
+}
+
+// SnapshotJSON returns the serialized snapshot of a block as stored, so that the
+// bytes can be compared across nodes. Snapshots only kept in memory, as those of
+// blocks other than the gap ones, are serialized on the fly.
+func (c *XDPoS) SnapshotJSON(hash common.Hash) ([]byte, error) {
+	if blob, err := c.snapshots.Get(hash); err == nil {
+		return blob, nil
+	}
+	if s, ok := c.recents.Peek(hash); ok {
+		return json.Marshal(s.(*Snapshot))
+	}
+	return nil, errUnknownBlock
 }
 
 func position(list []common.Address, x common.Address) int {
@@ -482,161 +872,1073 @@ func position(list []common.Address, x common.Address) int {
 	return -1
 }
 
+// CheckpointHeaderFor returns the header of the checkpoint block starting the
+// epoch of the given block number, the genesis block for the first epoch.
+func (c *XDPoS) CheckpointHeaderFor(chain consensus.ChainReader, number uint64) (*types.Header, error) {
+	checkpoint := number - number%c.config.Epoch
+	header := chain.GetHeaderByNumber(checkpoint)
+	if header == nil {
+		return nil, fmt.Errorf("checkpoint %d of block %d: %v", checkpoint, number, ErrMissingCheckpointHeader)
+	}
+	return header, nil
+}
+
 func (c *XDPoS) GetMasternodes(chain consensus.ChainReader, header *types.Header) []common.Address {
 	n := header.Number.Uint64()
 	e := c.config.Epoch
-	switch {
-	case n%e == 0:
-		return c.GetMasternodesFromCheckpointHeader(header, n, e)
-	case n%e != 0:
-		h := chain.GetHeaderByNumber(n - (n % e))
-		return c.GetMasternodesFromCheckpointHeader(h, n, e)
-	default:
-		return []common.Address{}
+	checkpoint := header
+	if n%e != 0 {
+		checkpoint, _ = c.CheckpointHeaderFor(chain, n)
 	}
+	return c.GetMasternodesFromCheckpointHeader(checkpoint, n, e)
 }
 
-func (c *XDPoS) GetPeriod() uint64 { return c.config.Period }
-
-func whoIsCreator(snap *Snapshot, header *types.Header) (common.Address, error) {
-	if header.Number.Uint64() == 0 {
-		return common.Address{}, errors.New("Don't take block 0")
+// IsAuthorisedAddressStrict returns whether the address is a masternode as of
+// the given header. Unlike a plain snapshot lookup, failing to load the snapshot
+// isn't reported as a non-member: the masternodes are read from the contract
+// instead, and an error is returned if they can't be determined either.
+func (c *XDPoS) IsAuthorisedAddressStrict(header *types.Header, chain consensus.ChainReader, address common.Address) (bool, error) {
+	snap, err := c.GetSnapshot(chain, header)
+	if err == nil {
+		_, ok := snap.Signers[address]
+		return ok, nil
 	}
-	m, err := ecrecover(header, snap.sigcache)
-	if err != nil {
-		return common.Address{}, err
+	if c.HookGetSignersFromContract == nil {
+		return false, err
 	}
-	return m, nil
+	if header.Number.Uint64()%c.config.Epoch == 0 {
+		if gapErr := c.VerifyGapAvailability(chain, header); gapErr != nil {
+			return false, fmt.Errorf("snapshot: %v, contract: %v", err, gapErr)
+		}
+	}
+	log.Warn("Can't get snapshot, reading masternodes from contract", "number", header.Number, "hash", header.Hash(), "err", err)
+	masternodes, contractErr := c.HookGetSignersFromContract(header.Hash())
+	if contractErr != nil {
+		return false, fmt.Errorf("snapshot: %v, contract: %v", err, contractErr)
+	}
+	return position(masternodes, address) >= 0, nil
 }
 
-func (c *XDPoS) YourTurn(chain consensus.ChainReader, parent *types.Header, signer common.Address) (int, int, int, bool, error) {
-	masternodes := c.GetMasternodes(chain, parent)
-
-	if common.IsTestnet {
-		// Only three mns hard code for XDC testnet.
-		masternodes = []common.Address{
-			common.HexToAddress("0xfFC679Dcdf444D2eEb0491A998E7902B411CcF20"),
-			common.HexToAddress("0xd76fd76F7101811726DCE9E43C2617706a4c45c8"),
-			common.HexToAddress("0x8A97753311aeAFACfd76a68Cf2e2a9808d3e65E8"),
+// VerifyGapAvailability checks that the headers of the gap preceding the given
+// checkpoint block are all available, as the masternodes of the checkpoint are
+// read from the contract at the start of the gap. The first missing header, the
+// one closest to the checkpoint, is reported.
+func (c *XDPoS) VerifyGapAvailability(chain consensus.ChainReader, checkpointHeader *types.Header) error {
+	number := checkpointHeader.Number.Uint64()
+	if number%c.config.Epoch != 0 {
+		return fmt.Errorf("block %d is not a checkpoint", number)
+	}
+	header := checkpointHeader
+	for i := uint64(1); i <= c.config.Gap && i <= number; i++ {
+		header = chain.GetHeader(header.ParentHash, number-i)
+		if header == nil {
+			return fmt.Errorf("block %d: %v", number-i, ErrMissingGapHeader)
 		}
 	}
+	return nil
+}
 
-	snap, err := c.GetSnapshot(chain, parent)
-	if err != nil {
-		log.Warn("Failed when trying to commit new work", "err", err)
-		return 0, -1, -1, false, err
+// GovernanceEvent is a masternode added to or removed from the set by the
+// governance contract.
+type GovernanceEvent struct {
+	Block      uint64         `json:"block"`      // Block number the event was emitted in
+	Masternode common.Address `json:"masternode"` // Masternode added or removed
+	Add        bool           `json:"add"`        // Whether the masternode was added or removed
+}
+
+// VerifySetAgainstEvents checks that the masternodes of a checkpoint block match
+// the set resulting from replaying the governance events in order. The events
+// emitted after the start of the gap preceding the checkpoint, when the set is
+// read from the contract, only take effect at the next checkpoint.
+func (c *XDPoS) VerifySetAgainstEvents(chain consensus.ChainReader, checkpointHeader *types.Header, events []GovernanceEvent) error {
+	number := checkpointHeader.Number.Uint64()
+	if number%c.config.Epoch != 0 {
+		return fmt.Errorf("block %d is not a checkpoint", number)
 	}
-	if len(masternodes) == 0 {
-		return 0, -1, -1, false, errors.New("Masternodes not found")
+	if chain.GetHeader(checkpointHeader.Hash(), number) == nil {
+		return errUnknownBlock
 	}
-	pre := common.Address{}
-	// masternode[0] has chance to create block 1
-	preIndex := -1
-	if parent.Number.Uint64() != 0 {
-		pre, err = whoIsCreator(snap, parent)
-		if err != nil {
-			return 0, 0, 0, false, err
+	expected := make(map[common.Address]struct{})
+	for _, event := range events {
+		if event.Block+c.config.Gap > number {
+			continue
+		}
+		if event.Add {
+			expected[event.Masternode] = struct{}{}
+		} else {
+			delete(expected, event.Masternode)
 		}
-		preIndex = position(masternodes, pre)
 	}
-	curIndex := position(masternodes, signer)
-	if signer == c.signer {
-		log.Debug("Masternodes cycle info", "number of masternodes", len(masternodes), "previous", pre, "position", preIndex, "current", signer, "position", curIndex)
+	var unexpected []common.Address
+	for _, masternode := range GetMasternodesFromCheckpointHeader(checkpointHeader) {
+		if _, ok := expected[masternode]; !ok {
+			unexpected = append(unexpected, masternode)
+		}
+		delete(expected, masternode)
 	}
-	for i, s := range masternodes {
-		log.Debug("Masternode:", "index", i, "address", s.String())
+	if len(expected) == 0 && len(unexpected) == 0 {
+		return nil
 	}
-	if (preIndex+1)%len(masternodes) == curIndex {
-		return len(masternodes), preIndex, curIndex, true, nil
+	missing := make([]common.Address, 0, len(expected))
+	for masternode := range expected {
+		missing = append(missing, masternode)
 	}
-	return len(masternodes), preIndex, curIndex, false, nil
+	sort.Slice(missing, func(i, j int) bool { return bytes.Compare(missing[i][:], missing[j][:]) < 0 })
+	return fmt.Errorf("checkpoint %d: %v (missing %v, unexpected %v)", number, ErrGovernanceSetMismatch, missing, unexpected)
 }
 
-// snapshot retrieves the authorization snapshot at a given point in time.
-func (c *XDPoS) snapshot(chain consensus.ChainReader, number uint64, hash common.Hash, parents []*types.Header) (*Snapshot, error) {
-	// Search for a snapshot in memory or on disk for checkpoints
-	var (
-		headers []*types.Header
-		snap    *Snapshot
-	)
-	for snap == nil {
-		// If an in-memory snapshot was found, use that
-		if s, ok := c.recents.Get(hash); ok {
-			snap = s.(*Snapshot)
-			break
-		}
-		// If an on-disk checkpoint snapshot can be found, use that
-		// checkpoint snapshot = checkpoint - gap
-		if (number+c.config.Gap)%c.config.Epoch == 0 {
-			if s, err := loadSnapshot(c.config, c.signatures, c.db, hash); err == nil {
-				log.Trace("Loaded voting snapshot form disk", "number", number, "hash", hash)
-				snap = s
-				break
-			}
-		}
-		// If we're at block zero, make a snapshot
-		if number == 0 {
-			genesis := chain.GetHeaderByNumber(0)
-			if err := c.VerifyHeader(chain, genesis, true); err != nil {
-				return nil, err
-			}
-			signers := make([]common.Address, (len(genesis.Extra)-extraVanity-extraSeal)/common.AddressLength)
-			for i := 0; i < len(signers); i++ {
-				copy(signers[i][:], genesis.Extra[extraVanity+i*common.AddressLength:])
-			}
-			snap = newSnapshot(c.config, c.signatures, 0, genesis.Hash(), signers)
-			if err := snap.store(c.db); err != nil {
-				return nil, err
-			}
-			log.Trace("Stored genesis voting snapshot to disk")
-			break
-		}
-		// No snapshot for this header, gather the header and move backward
-		var header *types.Header
-		if len(parents) > 0 {
-			// If we have explicit parents, pick from there (enforced)
-			header = parents[len(parents)-1]
-			if header.Hash() != hash || header.Number.Uint64() != number {
-				return nil, consensus.ErrUnknownAncestor
-			}
-			parents = parents[:len(parents)-1]
-		} else {
-			// No explicit parents (or no more left), reach out to the database
-			header = chain.GetHeader(hash, number)
-			if header == nil {
-				return nil, consensus.ErrUnknownAncestor
-			}
-		}
-		headers = append(headers, header)
-		number, hash = number-1, header.ParentHash
-	}
-	// Previous snapshot found, apply any pending headers on top of it
-	for i := 0; i < len(headers)/2; i++ {
-		headers[i], headers[len(headers)-1-i] = headers[len(headers)-1-i], headers[i]
+// shuffleMasternodes returns the masternodes in a pseudo random order derived
+// from the seed, so that the producing order rotates unpredictably from an epoch
+// to another while staying verifiable by anyone knowing the seed. Checkpoints
+// past the shuffle fork list their masternodes in that order, seeded with their
+// parent hash, which the turns and validators of the epoch then follow.
+func shuffleMasternodes(masternodes []common.Address, seed common.Hash) []common.Address {
+	shuffled := make([]common.Address, len(masternodes))
+	copy(shuffled, masternodes)
+	for i := len(shuffled) - 1; i > 0; i-- {
+		r := new(big.Int).SetBytes(crypto.Keccak256(seed[:], new(big.Int).SetInt64(int64(i)).Bytes()))
+		j := r.Mod(r, big.NewInt(int64(i+1))).Int64()
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	}
+	return shuffled
+}
+
+// SignerSetDiffAcrossReorg compares the masternodes in effect at the heads of
+// two branches, following each branch by parent hashes down to its checkpoint,
+// and returns the masternodes the reorg from the old head to the new one adds
+// and removes.
+func (c *XDPoS) SignerSetDiffAcrossReorg(chain consensus.ChainReader, oldHead, newHead *types.Header) ([]common.Address, []common.Address, error) {
+	oldCheckpoint, err := c.branchCheckpoint(chain, oldHead)
+	if err != nil {
+		return nil, nil, err
 	}
-	snap, err := snap.apply(headers)
+	newCheckpoint, err := c.branchCheckpoint(chain, newHead)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	c.recents.Add(snap.Hash, snap)
+	oldSet := GetMasternodesFromCheckpointHeader(oldCheckpoint)
+	newSet := GetMasternodesFromCheckpointHeader(newCheckpoint)
 
-	// If we've generated a new checkpoint snapshot, save to disk
-	if (snap.Number+c.config.Gap)%c.config.Epoch == 0 {
-		if err = snap.store(c.db); err != nil {
-			return nil, err
+	var added, removed []common.Address
+	for _, masternode := range newSet {
+		if position(oldSet, masternode) < 0 {
+			added = append(added, masternode)
 		}
-		log.Trace("Stored voting snapshot to disk", "number", snap.Number, "hash", snap.Hash)
 	}
-	return snap, err
+	for _, masternode := range oldSet {
+		if position(newSet, masternode) < 0 {
+			removed = append(removed, masternode)
+		}
+	}
+	return added, removed, nil
 }
 
-// VerifyUncles implements consensus.Engine, always returning an error for any
-// uncles as this consensus mechanism doesn't permit uncles.
-func (c *XDPoS) VerifyUncles(chain consensus.ChainReader, block *types.Block) error {
-	if len(block.Uncles()) > 0 {
-		return errors.New("uncles not allowed")
+// branchCheckpoint returns the checkpoint of the epoch of a header, following
+// the parent hashes rather than the canonical chain so that it works on any
+// branch.
+func (c *XDPoS) branchCheckpoint(chain consensus.ChainReader, header *types.Header) (*types.Header, error) {
+	for header.Number.Uint64()%c.config.Epoch != 0 {
+		parent := chain.GetHeader(header.ParentHash, header.Number.Uint64()-1)
+		if parent == nil {
+			return nil, consensus.ErrUnknownAncestor
+		}
+		header = parent
 	}
-	return nil
+	return header, nil
+}
+
+// MasternodeJoinedAt returns the checkpoint block since which the address has
+// continuously been a masternode, walking the checkpoints backward from the head
+// down to the given epoch at most. It reports false if the address isn't a
+// masternode at the head, or if it already was one at the oldest checkpoint
+// searched, the joining point being out of the window then.
+func (c *XDPoS) MasternodeJoinedAt(chain consensus.ChainReader, addr common.Address, searchFromEpoch uint64) (uint64, bool, error) {
+	head := chain.CurrentHeader()
+	if head == nil {
+		return 0, false, errUnknownBlock
+	}
+	e := c.config.Epoch
+	joined, found := uint64(0), false
+	for n := head.Number.Uint64() - head.Number.Uint64()%e; n >= searchFromEpoch*e; n -= e {
+		header := chain.GetHeaderByNumber(n)
+		if header == nil {
+			return 0, false, errUnknownBlock
+		}
+		if position(GetMasternodesFromCheckpointHeader(header), addr) < 0 {
+			return joined, found, nil
+		}
+		joined, found = n, true
+		if n == 0 {
+			// Masternode since genesis
+			return joined, found, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// AmIPenalised returns whether the local signer is excluded from the masternodes
+// at the given head because of a penalty of a recent checkpoint and, if so, the
+// last epoch it remains excluded for. A penalty applies to the epoch of the
+// checkpoint carrying it and to the LimitPenaltyEpoch following ones.
+func (c *XDPoS) AmIPenalised(chain consensus.ChainReader, head *types.Header) (bool, uint64, error) {
+	c.lock.RLock()
+	signer := c.signer
+	c.lock.RUnlock()
+
+	e := c.config.Epoch
+	checkpoint := head.Number.Uint64() - head.Number.Uint64()%e
+	for i := uint64(0); i <= common.LimitPenaltyEpoch && checkpoint >= i*e; i++ {
+		number := checkpoint - i*e
+		header := chain.GetHeaderByNumber(number)
+		if header == nil {
+			return false, 0, errUnknownBlock
+		}
+		if position(common.ExtractAddressFromBytes(header.Penalties), signer) >= 0 {
+			return true, number/e + common.LimitPenaltyEpoch, nil
+		}
+		if number == 0 {
+			break
+		}
+	}
+	return false, 0, nil
+}
+
+// removeRecentPenalties removes from the masternodes of a checkpoint those which
+// were penalised by any of the LimitPenaltyEpoch previous checkpoints. Together
+// with the penalties of the checkpoint itself, a penalty carried by checkpoint P
+// thus excludes a masternode up to checkpoint P+LimitPenaltyEpoch*Epoch, and it
+// is reinstated at checkpoint P+(LimitPenaltyEpoch+1)*Epoch.
+func (c *XDPoS) removeRecentPenalties(chain consensus.ChainReader, masternodes []common.Address, number uint64) []common.Address {
+	for i := uint64(1); i <= common.LimitPenaltyEpoch; i++ {
+		if number > i*c.config.Epoch {
+			masternodes = RemovePenaltiesFromBlock(chain, masternodes, number-i*c.config.Epoch)
+		}
+	}
+	return masternodes
+}
+
+// IsReinstatedAt returns whether the given checkpoint is the one reinstating an
+// address into the masternodes, meaning that its latest penalty has just expired
+// as described by removeRecentPenalties.
+func (c *XDPoS) IsReinstatedAt(chain consensus.ChainReader, checkpointHeader *types.Header, addr common.Address) (bool, error) {
+	e := c.config.Epoch
+	number := checkpointHeader.Number.Uint64()
+	if number%e != 0 {
+		return false, fmt.Errorf("block %d is not a checkpoint", number)
+	}
+	for i := uint64(0); i <= common.LimitPenaltyEpoch+1 && number >= i*e; i++ {
+		header := checkpointHeader
+		if i > 0 {
+			header = chain.GetHeaderByNumber(number - i*e)
+		}
+		if header == nil {
+			return false, errUnknownBlock
+		}
+		if position(common.ExtractAddressFromBytes(header.Penalties), addr) >= 0 {
+			// Only the penalty carried just before the exclusion window expires here
+			return i == common.LimitPenaltyEpoch+1, nil
+		}
+		if number == i*e {
+			break
+		}
+	}
+	return false, nil
+}
+
+// MasternodeSetHash returns a commitment to the effective masternode set of the
+// given epoch, as listed in its checkpoint header. The set is hashed in sorted
+// order so that all nodes agree on the value.
+func (c *XDPoS) MasternodeSetHash(chain consensus.ChainReader, epochNumber uint64) (common.Hash, error) {
+	header := chain.GetHeaderByNumber(epochNumber * c.config.Epoch)
+	if header == nil {
+		return common.Hash{}, errUnknownBlock
+	}
+	return masternodeSetHash(GetMasternodesFromCheckpointHeader(header)), nil
+}
+
+// masternodeSetHash hashes the set of masternodes in ascending order.
+func masternodeSetHash(masternodes []common.Address) common.Hash {
+	return crypto.Keccak256Hash(common.ExtractAddressToBytes(sortAddresses(masternodes)))
+}
+
+// SignedAttestation is a statement by a masternode of the masternode set in
+// effect at a given block, verifiable without trusting whoever relays it.
+type SignedAttestation struct {
+	SetHash   common.Hash   `json:"setHash"`   // Commitment to the masternode set, see MasternodeSetHash
+	Number    uint64        `json:"number"`    // Block number the set is attested at
+	Signature hexutil.Bytes `json:"signature"` // Signature of the attesting masternode
+}
+
+// hash returns the hash signed by the attesting masternode.
+func (a *SignedAttestation) hash() (hash common.Hash) {
+	hasher := sha3.NewKeccak256()
+	rlp.Encode(hasher, []interface{}{a.SetHash, a.Number})
+	hasher.Sum(hash[:0])
+	return hash
+}
+
+// AttestMasternodeSet signs with the local signer an attestation of the
+// masternode set in effect at the given head.
+func (c *XDPoS) AttestMasternodeSet(chain consensus.ChainReader, head *types.Header) (*SignedAttestation, error) {
+	c.lock.RLock()
+	signer, signFn := c.signer, c.signFn
+	c.lock.RUnlock()
+
+	if signFn == nil {
+		return nil, errNoSignFn
+	}
+	number := head.Number.Uint64()
+	setHash, err := c.MasternodeSetHash(chain, number/c.config.Epoch)
+	if err != nil {
+		return nil, err
+	}
+	attestation := &SignedAttestation{SetHash: setHash, Number: number}
+	attestation.Signature, err = signFn(accounts.Account{Address: signer}, attestation.hash().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return attestation, nil
+}
+
+// VerifyAttestation recovers the masternode which signed an attestation. It is
+// up to the caller to check that it is a masternode it trusts.
+func VerifyAttestation(attestation *SignedAttestation) (common.Address, error) {
+	pubkey, err := crypto.Ecrecover(attestation.hash().Bytes(), attestation.Signature)
+	if err != nil {
+		return common.Address{}, err
+	}
+	var signer common.Address
+	copy(signer[:], crypto.Keccak256(pubkey[1:])[12:])
+	return signer, nil
+}
+
+// sortAddresses returns a copy of the addresses in ascending order.
+func sortAddresses(addresses []common.Address) []common.Address {
+	sorted := make([]common.Address, len(addresses))
+	copy(sorted, addresses)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i][:], sorted[j][:]) < 0
+	})
+	return sorted
+}
+
+// CandidateVoteHistory reconstructs the votes cast on a candidate address from
+// the beneficiary and nonce of the blocks since the start of the given epoch up
+// to the head of the chain, in chronological order.
+func (c *XDPoS) CandidateVoteHistory(chain consensus.ChainReader, addr common.Address, fromEpoch uint64) ([]VoteRecord, error) {
+	head := chain.CurrentHeader()
+	if head == nil {
+		return nil, errUnknownBlock
+	}
+	var votes []VoteRecord
+	for n := fromEpoch * c.config.Epoch; n <= head.Number.Uint64(); n++ {
+		if n%c.config.Epoch == 0 {
+			// No votes are allowed on checkpoints, including the genesis block
+			continue
+		}
+		header := chain.GetHeaderByNumber(n)
+		if header == nil {
+			return nil, errUnknownBlock
+		}
+		if header.Coinbase != addr {
+			continue
+		}
+		signer, err := ecrecover(header, c.signatures)
+		if err != nil {
+			return nil, err
+		}
+		votes = append(votes, VoteRecord{
+			Block:     n,
+			Signer:    signer,
+			Authorize: bytes.Equal(header.Nonce[:], nonceAuthVote),
+		})
+	}
+	return votes, nil
+}
+
+// stateReader is implemented by chains giving access to historical states, like
+// the blockchain of an archive node.
+type stateReader interface {
+	StateAt(root common.Hash) (*state.StateDB, error)
+}
+
+// EstimateMasternodeRewards sums the rewards attributed to a masternode at the
+// reward checkpoints of the given epochs, both ends included. The rewards are
+// recomputed by replaying HookReward on top of the state preceding each reward
+// checkpoint, so the chain must give access to those historical states.
+func (c *XDPoS) EstimateMasternodeRewards(chain consensus.ChainReader, addr common.Address, fromEpoch, toEpoch uint64) (*big.Int, error) {
+	totals, err := c.replayRewards(chain, fromEpoch, toEpoch)
+	if err != nil {
+		return nil, err
+	}
+	if total, ok := totals[addr]; ok {
+		return total, nil
+	}
+	return new(big.Int), nil
+}
+
+// FairnessReport measures how evenly the rewards are spread among masternodes.
+type FairnessReport struct {
+	Totals      map[common.Address]*big.Int `json:"totals"`      // Rewards attributed to each masternode
+	Gini        float64                     `json:"gini"`        // Gini coefficient of the totals, 0 being perfectly even
+	MinMaxRatio float64                     `json:"minMaxRatio"` // Lowest total over the highest one, 1 being perfectly even
+}
+
+// RewardFairness replays the rewards of the given epochs, both ends included,
+// like EstimateMasternodeRewards, and measures their concentration among the
+// rewarded masternodes.
+func (c *XDPoS) RewardFairness(chain consensus.ChainReader, fromEpoch, toEpoch uint64) (*FairnessReport, error) {
+	totals, err := c.replayRewards(chain, fromEpoch, toEpoch)
+	if err != nil {
+		return nil, err
+	}
+	report := &FairnessReport{Totals: totals}
+	if len(totals) == 0 {
+		return report, nil
+	}
+	values := make([]*big.Int, 0, len(totals))
+	for _, total := range totals {
+		values = append(values, total)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Cmp(values[j]) < 0 })
+
+	// Gini = 2 * sum(i * x_i) / (n * sum(x_i)) - (n + 1) / n, with x ascending
+	var (
+		n        = int64(len(values))
+		sum      = new(big.Int)
+		weighted = new(big.Int)
+	)
+	for i, value := range values {
+		sum.Add(sum, value)
+		weighted.Add(weighted, new(big.Int).Mul(value, big.NewInt(int64(i+1))))
+	}
+	if sum.Sign() == 0 {
+		return report, nil
+	}
+	gini := new(big.Float).Quo(new(big.Float).SetInt(new(big.Int).Lsh(weighted, 1)), new(big.Float).SetInt(new(big.Int).Mul(sum, big.NewInt(n))))
+	gini.Sub(gini, new(big.Float).Quo(big.NewFloat(float64(n+1)), big.NewFloat(float64(n))))
+	report.Gini, _ = gini.Float64()
+	report.MinMaxRatio, _ = new(big.Float).Quo(new(big.Float).SetInt(values[0]), new(big.Float).SetInt(values[n-1])).Float64()
+	return report, nil
+}
+
+// replayRewards recomputes the rewards attributed to each masternode at the
+// reward checkpoints of the given epochs, summing up the shares of all their
+// holders.
+func (c *XDPoS) replayRewards(chain consensus.ChainReader, fromEpoch, toEpoch uint64) (map[common.Address]*big.Int, error) {
+	if c.HookReward == nil {
+		return nil, errors.New("reward hook not set")
+	}
+	states, ok := chain.(stateReader)
+	if !ok {
+		return nil, errors.New("historical states not available")
+	}
+	rCheckpoint := chain.Config().XDPoS.RewardCheckpoint
+	totals := make(map[common.Address]*big.Int)
+	for epoch := fromEpoch; epoch <= toEpoch; epoch++ {
+		number := epoch * c.config.Epoch
+		if number == 0 || rCheckpoint == 0 || number%rCheckpoint != 0 {
+			continue
+		}
+		header := chain.GetHeaderByNumber(number)
+		if header == nil {
+			return nil, errUnknownBlock
+		}
+		parent := chain.GetHeader(header.ParentHash, number-1)
+		if parent == nil {
+			return nil, consensus.ErrUnknownAncestor
+		}
+		statedb, err := states.StateAt(parent.Root)
+		if err != nil {
+			return nil, err
+		}
+		err, rewards := c.HookReward(chain, statedb, header)
+		if err != nil {
+			return nil, err
+		}
+		signers, _ := rewards["rewards"].(map[common.Address]interface{})
+		for signer, holders := range signers {
+			holders, _ := holders.(map[common.Address]*big.Int)
+			if totals[signer] == nil {
+				totals[signer] = new(big.Int)
+			}
+			for _, reward := range holders {
+				totals[signer].Add(totals[signer], reward)
+			}
+		}
+	}
+	return totals, nil
+}
+
+// NextRewardBlocks returns the numbers of the next count blocks following the
+// current one at which the rewards will be distributed.
+func (c *XDPoS) NextRewardBlocks(currentNumber uint64, count int) []uint64 {
+	r := c.config.RewardCheckpoint
+	if r == 0 || count <= 0 {
+		return nil
+	}
+	blocks := make([]uint64, count)
+	next := currentNumber - currentNumber%r + r
+	for i := range blocks {
+		blocks[i] = next + uint64(i)*r
+	}
+	return blocks
+}
+
+func (c *XDPoS) GetPeriod() uint64 { return c.config.Period }
+
+// sealingPeriod returns the block period used when producing blocks.
+func (c *XDPoS) sealingPeriod() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.sealPeriod
+}
+
+// ReloadConfig swaps the parameters used when producing blocks which are safe
+// to change at runtime: the block period and the recent signer limit. Blocks are
+// still verified against the configuration of the chain, so the new values may
+// only be stricter than it, and the limit must fit the masternodes at the head
+// of the chain. Any other parameter changed, like the epoch or the gap which
+// shape the chain itself, is rejected as it requires a restart.
+func (c *XDPoS) ReloadConfig(chain consensus.ChainReader, config *params.XDPoSConfig) error {
+	if config == nil {
+		return errors.New("missing XDPoS config")
+	}
+	conf := *config
+	if conf.Epoch == 0 {
+		conf.Epoch = epochLength
+	}
+	if conf.RecentSignerLimit == 0 {
+		conf.RecentSignerLimit = recentSignerLimit
+	}
+	switch {
+	case conf.Epoch != c.config.Epoch:
+		return fmt.Errorf("epoch can't be changed at runtime: have %d, want %d", c.config.Epoch, conf.Epoch)
+	case conf.Gap != c.config.Gap:
+		return fmt.Errorf("gap can't be changed at runtime: have %d, want %d", c.config.Gap, conf.Gap)
+	case conf.Reward != c.config.Reward || conf.RewardCheckpoint != c.config.RewardCheckpoint || conf.FoudationWalletAddr != c.config.FoudationWalletAddr:
+		return errors.New("rewards can't be changed at runtime")
+	case !forkBlockEqual(conf.CheckpointValidatorsBlock, c.config.CheckpointValidatorsBlock) || !forkBlockEqual(conf.ShuffleMasternodesBlock, c.config.ShuffleMasternodesBlock):
+		return errors.New("fork blocks can't be changed at runtime")
+	case conf.Period < c.config.Period:
+		return fmt.Errorf("block period can't be lowered below the chain's: have %d, want %d", c.config.Period, conf.Period)
+	case conf.RecentSignerLimit < c.config.RecentSignerLimit:
+		return fmt.Errorf("recent signer limit can't be lowered below the chain's: have %d, want %d", c.config.RecentSignerLimit, conf.RecentSignerLimit)
+	}
+	// Reject any other change, so that new parameters are not silently ignored
+	fixed := conf
+	fixed.Period, fixed.RecentSignerLimit = c.config.Period, c.config.RecentSignerLimit
+	fixed.CheckpointValidatorsBlock, fixed.ShuffleMasternodesBlock = c.config.CheckpointValidatorsBlock, c.config.ShuffleMasternodesBlock
+	if fixed != *c.config {
+		return fmt.Errorf("XDPoS config can't be changed at runtime: have %+v, want %+v", *c.config, conf)
+	}
+	head := chain.CurrentHeader()
+	if head == nil {
+		return errUnknownBlock
+	}
+	if err := verifyRecentSignerLimit(conf.RecentSignerLimit, c.GetMasternodes(chain, head)); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if conf.Period != c.sealPeriod {
+		log.Info("Reloaded XDPoS block period", "old", c.sealPeriod, "new", conf.Period)
+		c.sealPeriod = conf.Period
+	}
+	if conf.RecentSignerLimit != c.sealSignerLimit {
+		log.Info("Reloaded XDPoS recent signer limit", "old", c.sealSignerLimit, "new", conf.RecentSignerLimit)
+		c.sealSignerLimit = conf.RecentSignerLimit
+	}
+	return nil
+}
+
+// forkBlockEqual returns whether two fork blocks are the same, nil meaning the
+// fork isn't scheduled.
+func forkBlockEqual(x, y *big.Int) bool {
+	if x == nil || y == nil {
+		return x == y
+	}
+	return x.Cmp(y) == 0
+}
+
+// recentSignersWindow returns the number of recent signers a snapshot keeps
+// track of for the given number of masternodes, the older ones being pruned.
+func recentSignersWindow(masternodes int) uint64 {
+	return uint64(masternodes/2 + 1)
+}
+
+// verifyRecentSignerLimit checks that the recent signer limit fits within the
+// recent signers kept by the snapshots, as a larger limit would have no effect.
+func verifyRecentSignerLimit(limit uint64, masternodes []common.Address) error {
+	if window := recentSignersWindow(len(masternodes)); len(masternodes) > 0 && limit > window {
+		return fmt.Errorf("recent signer limit %d exceeds the %d recent signers kept for %d masternodes", limit, window, len(masternodes))
+	}
+	return nil
+}
+
+// ConsensusConfig is the effective consensus configuration of the engine.
+type ConsensusConfig struct {
+	params.XDPoSConfig
+
+	Bootstrap                bool             `json:"bootstrap"`                // Checkpoints without masternodes are accepted
+	StrictBlockTime          bool             `json:"strictBlockTime"`          // Blocks aren't produced once their slot has passed
+	StructuralGenesis        bool             `json:"structuralGenesis"`        // Only the structure of the genesis is checked
+	MaxPenaltyPercent        uint64           `json:"maxPenaltyPercent"`        // Maximum share of the masternodes penalised at once
+	EmergencyMasternodes     []common.Address `json:"emergencyMasternodes"`     // Masternodes used if none are found
+	FutureBlockTolerance     time.Duration    `json:"futureBlockTolerance"`     // Allowed clock drift of headers received live
+	SyncFutureBlockTolerance time.Duration    `json:"syncFutureBlockTolerance"` // Allowed clock drift of headers imported while syncing
+	LimitPenaltyEpoch        uint64           `json:"limitPenaltyEpoch"`        // Number of epochs a penalty lasts
+	MergeSignRange           uint64           `json:"mergeSignRange"`           // Interval of the blocks signed by the masternodes
+}
+
+// ExportConsensusConfig serializes the effective consensus configuration of the
+// engine into JSON, so that it can be compared across nodes.
+func (c *XDPoS) ExportConsensusConfig() ([]byte, error) {
+	c.lock.RLock()
+	conf := *c.config
+	c.lock.RUnlock()
+
+	return json.Marshal(&ConsensusConfig{
+		XDPoSConfig:              conf,
+		Bootstrap:                c.Bootstrap,
+		StrictBlockTime:          c.StrictBlockTime,
+		StructuralGenesis:        c.StructuralGenesis,
+		MaxPenaltyPercent:        c.MaxPenaltyPercent,
+		EmergencyMasternodes:     c.EmergencyMasternodes,
+		FutureBlockTolerance:     c.FutureBlockTolerance,
+		SyncFutureBlockTolerance: c.SyncFutureBlockTolerance,
+		LimitPenaltyEpoch:        common.LimitPenaltyEpoch,
+		MergeSignRange:           common.MergeSignRange,
+	})
+}
+
+// VerifyGenesisConsistency checks that the genesis block of the chain can be
+// run with the engine parameters. It is meant to be called at startup to fail
+// fast instead of stalling at the first checkpoint.
+func (c *XDPoS) VerifyGenesisConsistency(chain consensus.ChainReader) error {
+	genesis := chain.GetHeaderByNumber(0)
+	if genesis == nil {
+		return errUnknownBlock
+	}
+	if config := chain.Config().XDPoS; config != nil {
+		epoch := config.Epoch
+		if epoch == 0 {
+			epoch = epochLength
+		}
+		if epoch != c.config.Epoch || config.Gap != c.config.Gap {
+			return fmt.Errorf("XDPoS engine config mismatch: chain epoch %d gap %d, engine epoch %d gap %d", epoch, config.Gap, c.config.Epoch, c.config.Gap)
+		}
+	}
+	if c.config.Gap >= c.config.Epoch {
+		return fmt.Errorf("XDPoS gap %d not below epoch %d", c.config.Gap, c.config.Epoch)
+	}
+	if c.config.RewardCheckpoint%c.config.Epoch != 0 {
+		return fmt.Errorf("XDPoS reward checkpoint %d not a multiple of epoch %d", c.config.RewardCheckpoint, c.config.Epoch)
+	}
+	if len(genesis.Extra) < extraVanity+extraSeal {
+		return errMissingSignature
+	}
+	if (len(genesis.Extra)-extraVanity-extraSeal)%common.AddressLength != 0 {
+		return errInvalidCheckpointSigners
+	}
+	masternodes := GetMasternodesFromCheckpointHeader(genesis)
+	if len(masternodes) == 0 && !c.Bootstrap {
+		return ErrEmptyCheckpointSigners
+	}
+	seen := make(map[common.Address]struct{}, len(masternodes))
+	for _, masternode := range masternodes {
+		if _, ok := seen[masternode]; ok {
+			return fmt.Errorf("duplicate masternode %x in genesis", masternode)
+		}
+		seen[masternode] = struct{}{}
+	}
+	return verifyRecentSignerLimit(c.config.RecentSignerLimit, masternodes)
+}
+
+func whoIsCreator(snap *Snapshot, header *types.Header) (common.Address, error) {
+	if header.Number.Uint64() == 0 {
+		return common.Address{}, errors.New("Don't take block 0")
+	}
+	m, err := ecrecover(header, snap.sigcache)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return m, nil
+}
+
+// MintingSchedule tells whether a signer is scheduled to mint the block on top
+// of a parent, and how far its turn is in the round-robin.
+type MintingSchedule struct {
+	Masternodes int  `json:"masternodes"` // Number of masternodes of the epoch
+	PreIndex    int  `json:"preIndex"`    // Position of the creator of the parent
+	CurIndex    int  `json:"curIndex"`    // Position of the signer, -1 if not a masternode
+	Hop         int  `json:"hop"`         // Number of masternodes minting before the signer, -1 if not a masternode
+	Turn        bool `json:"turn"`        // Whether the signer is allowed to mint the next block
+}
+
+// GetMintingSchedule returns the minting schedule of the signer on top of the
+// parent, as computed by YourTurn.
+func (c *XDPoS) GetMintingSchedule(chain consensus.ChainReader, parent *types.Header, signer common.Address) (*MintingSchedule, error) {
+	len, preIndex, curIndex, ok, err := c.YourTurn(chain, parent, signer)
+	if err != nil {
+		return nil, err
+	}
+	schedule := &MintingSchedule{Masternodes: len, PreIndex: preIndex, CurIndex: curIndex, Hop: -1, Turn: ok}
+	if curIndex >= 0 {
+		schedule.Hop = Hop(len, preIndex, curIndex)
+	}
+	return schedule, nil
+}
+
+func (c *XDPoS) YourTurn(chain consensus.ChainReader, parent *types.Header, signer common.Address) (int, int, int, bool, error) {
+	return c.yourTurn(chain, parent, signer, true)
+}
+
+// yourTurn reports whether it's the signer's turn to seal the block on top of
+// the parent. The emergency masternodes are local configuration rather than
+// consensus data, so they're only considered when producing blocks, never when
+// computing the difficulty a block is verified against.
+func (c *XDPoS) yourTurn(chain consensus.ChainReader, parent *types.Header, signer common.Address, emergency bool) (int, int, int, bool, error) {
+	var masternodes []common.Address
+	if common.IsTestnet {
+		// Only three mns hard code for XDC testnet.
+		masternodes = []common.Address{
+			common.HexToAddress("0xfFC679Dcdf444D2eEb0491A998E7902B411CcF20"),
+			common.HexToAddress("0xd76fd76F7101811726DCE9E43C2617706a4c45c8"),
+			common.HexToAddress("0x8A97753311aeAFACfd76a68Cf2e2a9808d3e65E8"),
+		}
+	} else {
+		masternodes = c.GetMasternodes(chain, parent)
+		if len(masternodes) == 0 && emergency && len(c.EmergencyMasternodes) > 0 {
+			log.Error("No masternodes found, falling back to emergency masternodes", "number", parent.Number.Uint64()+1, "masternodes", c.EmergencyMasternodes)
+			masternodes = c.EmergencyMasternodes
+		}
+	}
+	if len(masternodes) == 0 {
+		if emergency {
+			log.Error("No masternodes found, halting block production", "number", parent.Number.Uint64()+1)
+		}
+		return 0, -1, -1, false, errNoMasternodes
+	}
+	snap, err := c.GetSnapshot(chain, parent)
+	if err != nil {
+		log.Warn("Failed when trying to commit new work", "err", err)
+		return 0, -1, -1, false, err
+	}
+	pre := common.Address{}
+	// masternode[0] has chance to create block 1
+	preIndex := -1
+	if parent.Number.Uint64() != 0 {
+		pre, err = whoIsCreator(snap, parent)
+		if err != nil {
+			return 0, 0, 0, false, err
+		}
+		preIndex = position(masternodes, pre)
+	}
+	curIndex := position(masternodes, signer)
+	if signer == c.signer {
+		log.Debug("Masternodes cycle info", "number of masternodes", len(masternodes), "previous", pre, "position", preIndex, "current", signer, "position", curIndex)
+	}
+	for i, s := range masternodes {
+		log.Debug("Masternode:", "index", i, "address", s.String())
+	}
+	if (preIndex+1)%len(masternodes) == curIndex {
+		return len(masternodes), preIndex, curIndex, true, nil
+	}
+	return len(masternodes), preIndex, curIndex, false, nil
+}
+
+// snapshot retrieves the authorization snapshot at a given point in time.
+func (c *XDPoS) snapshot(chain consensus.ChainReader, number uint64, hash common.Hash, parents []*types.Header) (*Snapshot, error) {
+	// Search for a snapshot in memory or on disk for checkpoints
+	var (
+		headers []*types.Header
+		snap    *Snapshot
+	)
+	for snap == nil {
+		// If an in-memory snapshot was found, use that
+		if s, ok := c.recents.Get(hash); ok {
+			snap = s.(*Snapshot)
+			break
+		}
+		// If an on-disk checkpoint snapshot can be found, use that
+		// checkpoint snapshot = checkpoint - gap
+		if (number+c.config.Gap)%c.config.Epoch == 0 {
+			if s, err := loadSnapshot(c.config, c.signatures, c.snapshots, hash); err == nil {
+				log.Trace("Loaded voting snapshot form disk", "number", number, "hash", hash)
+				snap = s
+				break
+			}
+		}
+		// If we're at block zero, make a snapshot
+		if number == 0 {
+			genesis := chain.GetHeaderByNumber(0)
+			if c.StructuralGenesis {
+				if _, err := c.ValidateCheckpointExtra(genesis); err != nil {
+					return nil, err
+				}
+			} else if err := c.VerifyHeader(chain, genesis, true); err != nil {
+				return nil, err
+			}
+			snap = newSnapshot(c.config, c.signatures, 0, genesis.Hash(), GetMasternodesFromCheckpointHeader(genesis))
+			if err := snap.store(c.snapshots); err != nil {
+				return nil, err
+			}
+			log.Trace("Stored genesis voting snapshot to disk")
+			break
+		}
+		// No snapshot for this header, gather the header and move backward
+		var header *types.Header
+		if len(parents) > 0 {
+			// If we have explicit parents, pick from there (enforced)
+			header = parents[len(parents)-1]
+			if header.Hash() != hash || header.Number.Uint64() != number {
+				return nil, consensus.ErrUnknownAncestor
+			}
+			parents = parents[:len(parents)-1]
+		} else {
+			// No explicit parents (or no more left), reach out to the database
+			header = chain.GetHeader(hash, number)
+			if header == nil {
+				return nil, consensus.ErrUnknownAncestor
+			}
+		}
+		headers = append(headers, header)
+		number, hash = number-1, header.ParentHash
+	}
+	// Previous snapshot found, apply any pending headers on top of it
+	for i := 0; i < len(headers)/2; i++ {
+		headers[i], headers[len(headers)-1-i] = headers[len(headers)-1-i], headers[i]
+	}
+	snap, err := snap.apply(headers)
+	if err != nil {
+		return nil, err
+	}
+	if len(headers) > 0 {
+		atomic.AddUint64(&c.counters.snapshotsComputed, 1)
+		c.forgetDifficulties(snap.Hash)
+	}
+	c.recents.Add(snap.Hash, snap)
+
+	// If we've generated a new checkpoint snapshot, save to disk
+	if (snap.Number+c.config.Gap)%c.config.Epoch == 0 {
+		if err = snap.store(c.snapshots); err != nil {
+			return nil, err
+		}
+		log.Trace("Stored voting snapshot to disk", "number", snap.Number, "hash", snap.Hash)
+	}
+	return snap, err
+}
+
+// ComputeSnapshot re-derives the snapshot at a given point in time purely from
+// the headers, replaying them all on top of the genesis signers. Unlike snapshot
+// it never reads from or writes to the database nor the in-memory snapshot
+// cache, so it can be used to audit the persisted snapshots. Note that masternode
+// sets installed through UpdateMasternodes come from the validator contract and
+// are not reflected in the computed snapshot.
+func (c *XDPoS) ComputeSnapshot(chain consensus.ChainReader, number uint64, hash common.Hash, parents []*types.Header) (*Snapshot, error) {
+	var headers []*types.Header
+	for number > 0 {
+		var header *types.Header
+		if len(parents) > 0 {
+			// If we have explicit parents, pick from there (enforced)
+			header = parents[len(parents)-1]
+			if header.Hash() != hash || header.Number.Uint64() != number {
+				return nil, consensus.ErrUnknownAncestor
+			}
+			parents = parents[:len(parents)-1]
+		} else {
+			header = chain.GetHeader(hash, number)
+			if header == nil {
+				return nil, consensus.ErrUnknownAncestor
+			}
+		}
+		headers = append(headers, header)
+		number, hash = number-1, header.ParentHash
+	}
+	genesis := chain.GetHeader(hash, 0)
+	if genesis == nil {
+		return nil, consensus.ErrUnknownAncestor
+	}
+	snap := newSnapshot(c.config, c.signatures, 0, genesis.Hash(), GetMasternodesFromCheckpointHeader(genesis))
+
+	for i := 0; i < len(headers)/2; i++ {
+		headers[i], headers[len(headers)-1-i] = headers[len(headers)-1-i], headers[i]
+	}
+	return snap.apply(headers)
+}
+
+// Sources a snapshot can be obtained from, as reported by SnapshotProvenance.
+const (
+	SnapshotFromMemory    = "memory"    // Snapshot cached in memory
+	SnapshotFromDisk      = "disk"      // Checkpoint snapshot loaded from the snapshot store
+	SnapshotFromRecompute = "recompute" // Snapshot derived by applying headers on an older one
+	SnapshotFromContract  = "contract"  // Masternodes read from the contract, the snapshot being unavailable
+)
+
+// ProvenanceReport details where the snapshot of a block comes from, and the
+// signers each of the possible sources yields for it.
+type ProvenanceReport struct {
+	Number      uint64           `json:"number"`      // Block number of the snapshot
+	Hash        common.Hash      `json:"hash"`        // Block hash of the snapshot
+	Source      string           `json:"source"`      // Source the engine currently takes the snapshot from
+	Memory      []common.Address `json:"memory"`      // Signers of the in-memory snapshot, if any
+	Disk        []common.Address `json:"disk"`        // Signers of the stored snapshot, if any
+	Recomputed  []common.Address `json:"recomputed"`  // Signers derived from the headers since genesis, if possible
+	Contract    []common.Address `json:"contract"`    // Masternodes read from the contract, if HookGetSignersFromContract is set
+	Masternodes []common.Address `json:"masternodes"` // Masternodes of the checkpoint, which seal verification falls back to
+}
+
+// SnapshotProvenance reports where the snapshot of the given block comes from,
+// together with the signers yielded by each source, to locate where nodes start
+// diverging about a block. The in-memory and stored snapshots are inspected
+// without being altered. If the snapshot can't be derived from any of them, the
+// masternodes read from the contract are reported as its source, the way
+// IsAuthorisedAddressStrict falls back to them.
+func (c *XDPoS) SnapshotProvenance(chain consensus.ChainReader, number uint64, hash common.Hash) (*ProvenanceReport, error) {
+	header := chain.GetHeader(hash, number)
+	if header == nil {
+		return nil, errUnknownBlock
+	}
+	report := &ProvenanceReport{
+		Number:      number,
+		Hash:        hash,
+		Source:      SnapshotFromRecompute,
+		Masternodes: c.GetMasternodes(chain, header),
+	}
+	if s, ok := c.recents.Peek(hash); ok {
+		report.Source = SnapshotFromMemory
+		report.Memory = s.(*Snapshot).GetSigners()
+	}
+	if (number+c.config.Gap)%c.config.Epoch == 0 {
+		if s, err := loadSnapshot(c.config, c.signatures, c.snapshots, hash); err == nil {
+			if report.Source == SnapshotFromRecompute {
+				report.Source = SnapshotFromDisk
+			}
+			report.Disk = s.GetSigners()
+		}
+	}
+	snap, err := c.ComputeSnapshot(chain, number, hash, nil)
+	if err == nil {
+		report.Recomputed = snap.GetSigners()
+	}
+	if c.HookGetSignersFromContract == nil {
+		if err != nil {
+			return nil, err
+		}
+		return report, nil
+	}
+	masternodes, contractErr := c.HookGetSignersFromContract(hash)
+	if contractErr != nil {
+		if err != nil {
+			return nil, fmt.Errorf("recompute: %v, contract: %v", err, contractErr)
+		}
+		log.Warn("Can't read masternodes from contract", "number", number, "hash", hash, "err", contractErr)
+		return report, nil
+	}
+	report.Contract = masternodes
+	if err != nil && report.Source == SnapshotFromRecompute {
+		report.Source = SnapshotFromContract
+	}
+	return report, nil
+}
+
+// RebuildSnapshots repairs corrupted snapshots by recomputing them from the
+// genesis block up to the given one. The headers are replayed on top of the
+// genesis signers, and at every gap block the signers are replaced by the
+// masternodes taking effect at the next checkpoint, as UpdateMasternodes does
+// on a live node. Once all of them are recomputed, every stored snapshot is
+// deleted, including those of side forks, and the rebuilt ones are persisted.
+// It is a maintenance operation which should only be triggered explicitly,
+// while no blocks are being imported.
+func (c *XDPoS) RebuildSnapshots(chain consensus.ChainReader, upTo uint64) error {
+	genesis := chain.GetHeaderByNumber(0)
+	if genesis == nil {
+		return errUnknownBlock
+	}
+	snap := newSnapshot(c.config, c.signatures, 0, genesis.Hash(), GetMasternodesFromCheckpointHeader(genesis))
+	var (
+		rebuilt = []*Snapshot{snap}
+		headers []*types.Header
+		err     error
+	)
+	parent := genesis
+	for number := uint64(1); number <= upTo; number++ {
+		header := chain.GetHeaderByNumber(number)
+		if header == nil || header.ParentHash != parent.Hash() {
+			return errUnknownBlock
+		}
+		headers = append(headers, header)
+		parent = header
+
+		gap := (number+c.config.Gap)%c.config.Epoch == 0
+		if !gap && number != upTo {
+			continue
+		}
+		if snap, err = snap.apply(headers); err != nil {
+			return err
+		}
+		headers = headers[:0]
+		if gap {
+			masternodes, err := c.gapMasternodes(chain, header)
+			if err != nil {
+				return err
+			}
+			snap.Signers = make(map[common.Address]struct{}, len(masternodes))
+			for _, masternode := range masternodes {
+				snap.Signers[masternode] = struct{}{}
+			}
+			rebuilt = append(rebuilt, snap)
+		}
+	}
+	// All snapshots recomputed, replace the stored ones
+	hashes, err := c.snapshots.Hashes()
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if err := c.snapshots.Delete(hash); err != nil {
+			return err
+		}
+	}
+	log.Info("Deleted stored voting snapshots", "count", len(hashes))
+	c.recents.Purge()
+	c.difficulties.Purge()
+
+	for _, s := range rebuilt {
+		if err := s.store(c.snapshots); err != nil {
+			return err
+		}
+		log.Info("Rebuilt voting snapshot", "number", s.Number, "hash", s.Hash)
+	}
+	c.recents.Add(snap.Hash, snap)
+	return nil
+}
+
+// gapMasternodes returns the masternodes installed into the snapshot of a gap
+// block, read from the contract if HookGetSignersFromContract is set, or from
+// the checkpoint following the gap otherwise.
+func (c *XDPoS) gapMasternodes(chain consensus.ChainReader, gap *types.Header) ([]common.Address, error) {
+	if c.HookGetSignersFromContract != nil {
+		return c.HookGetSignersFromContract(gap.Hash())
+	}
+	number := gap.Number.Uint64() + c.config.Gap
+	checkpoint := chain.GetHeaderByNumber(number)
+	if checkpoint == nil {
+		return nil, fmt.Errorf("masternodes of gap block %d: %v", gap.Number, ErrMissingCheckpointHeader)
+	}
+	return GetMasternodesFromCheckpointHeader(checkpoint), nil
+}
+
+// VerifyUncles implements consensus.Engine, always returning an error for any
+// uncles as this consensus mechanism doesn't permit uncles.
+func (c *XDPoS) VerifyUncles(chain consensus.ChainReader, block *types.Block) error {
+	if len(block.Uncles()) > 0 {
+		return errors.New("uncles not allowed")
+	}
+	return nil
 }
 
 // VerifySeal implements consensus.Engine, checking whether the signature contained
@@ -663,100 +1965,351 @@ func (c *XDPoS) verifySeal(chain consensus.ChainReader, header *types.Header, pa
 		return err
 	}
 
-	// Resolve the authorization key and check against signers
-	creator, err := ecrecover(header, c.signatures)
-	if err != nil {
-		return err
+	// Resolve the authorization key and check against signers
+	creator, err := ecrecover(header, c.signatures)
+	if err != nil {
+		return err
+	}
+	var parent *types.Header
+	if len(parents) > 0 {
+		parent = parents[len(parents)-1]
+	} else {
+		parent = chain.GetHeader(header.ParentHash, number-1)
+	}
+	detail := c.CalcDifficultyDetail(chain, parent, creator)
+	difficulty := detail.Difficulty
+	log.Debug("verify seal block", "number", header.Number, "hash", header.Hash(), "block difficulty", header.Difficulty, "calc difficulty", difficulty, "creator", creator)
+	// Ensure that the block's difficulty is meaningful (may not be correct at this point)
+	if number > 0 {
+		if header.Difficulty.Int64() != difficulty.Int64() {
+			if c.DiagnoseDifficulty {
+				log.Warn("Block difficulty mismatch", "number", number, "hash", header.Hash(), "creator", creator, "have", header.Difficulty, "want", difficulty,
+					"masternodes", detail.Masternodes, "preIndex", detail.PreIndex, "curIndex", detail.CurIndex, "hop", detail.Hop)
+			}
+			return errInvalidDifficulty
+		}
+	}
+	masternodes := c.GetMasternodes(chain, header)
+	mstring := []string{}
+	for _, m := range masternodes {
+		mstring = append(mstring, m.String())
+	}
+	nstring := []string{}
+	for _, n := range snap.GetSigners() {
+		nstring = append(nstring, n.String())
+	}
+	if _, ok := snap.Signers[creator]; !ok {
+		valid := false
+		for _, m := range masternodes {
+			if m == creator {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			log.Debug("Unauthorized creator found", "block number", number, "creator", creator.String(), "masternodes", mstring, "snapshot from parent block", nstring)
+			return errUnauthorized
+		}
+	}
+	if c.signedRecently(snap, masternodes, creator, number, c.config.RecentSignerLimit) {
+		return errUnauthorized
+	}
+
+	// header must contain validator info following double validation design
+	// start checking from epoch 2nd.
+	if c.isDoubleValidated(number) && fullVerify {
+		validator, err := c.RecoverValidator(header)
+		if err != nil {
+			return err
+		}
+
+		// verify validator
+		assignedValidator, err := c.GetValidator(creator, chain, header)
+		if err != nil {
+			return err
+		}
+		if err := verifyValidator(validator, assignedValidator, masternodes); err != nil {
+			log.Debug("Bad block detected. Header contains wrong pair of creator-validator", "creator", creator, "assigned validator", assignedValidator, "validator", validator, "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// signedRecently returns whether the signer sealed one of the last limit-1
+// blocks of the snapshot, and thus is not allowed to seal the block with the
+// given number. It only applies to non-epoch blocks of networks with more than
+// one masternode.
+func (c *XDPoS) signedRecently(snap *Snapshot, masternodes []common.Address, signer common.Address, number uint64, limit uint64) bool {
+	if len(masternodes) <= 1 || number%c.config.Epoch == 0 {
+		return false
+	}
+	// The limit can't exceed the recent signers kept by the snapshot. Larger
+	// limits are rejected when the config or the masternodes are loaded, the
+	// cap is only a fallback.
+	if window := recentSignersWindow(len(masternodes)); limit > window {
+		limit = window
+	}
+	for seen, recent := range snap.Recents {
+		// Signer is among recents, only refuse if the current block doesn't shift it out
+		if recent == signer && (number < limit || seen > number-limit) {
+			return true
+		}
+	}
+	return false
+}
+
+// ActualNextProducer returns the masternode which will actually be allowed to
+// seal the block on top of the parent. It starts from the in-turn masternode
+// following the parent's creator, and skips those excluded by the recent signer
+// rule exactly as Seal and verifySeal do.
+func (c *XDPoS) ActualNextProducer(chain consensus.ChainReader, parent *types.Header) (common.Address, error) {
+	masternodes := c.GetMasternodes(chain, parent)
+	if len(masternodes) == 0 {
+		return common.Address{}, errNoMasternodes
+	}
+	snap, err := c.GetSnapshot(chain, parent)
+	if err != nil {
+		return common.Address{}, err
+	}
+	preIndex := -1
+	if parent.Number.Uint64() != 0 {
+		pre, err := whoIsCreator(snap, parent)
+		if err != nil {
+			return common.Address{}, err
+		}
+		preIndex = position(masternodes, pre)
+	}
+	number := parent.Number.Uint64() + 1
+	for i := 1; i <= len(masternodes); i++ {
+		candidate := masternodes[(preIndex+i)%len(masternodes)]
+		if !c.signedRecently(snap, masternodes, candidate, number, c.config.RecentSignerLimit) {
+			return candidate, nil
+		}
+	}
+	return common.Address{}, errNoProducer
+}
+
+// OutOfTurnBlocks returns the numbers of the blocks of an epoch, up to the head
+// of the chain, which were not sealed by the producer ActualNextProducer expects
+// on top of their parent. Under honest operation the list is empty, any entry
+// points at contention between masternodes.
+func (c *XDPoS) OutOfTurnBlocks(chain consensus.ChainReader, epochNumber uint64) ([]uint64, error) {
+	head := chain.CurrentHeader()
+	if head == nil {
+		return nil, errUnknownBlock
+	}
+	first, last := epochNumber*c.config.Epoch, (epochNumber+1)*c.config.Epoch-1
+	if first == 0 {
+		// The genesis block isn't produced by anyone
+		first = 1
+	}
+	if last > head.Number.Uint64() {
+		last = head.Number.Uint64()
+	}
+	if first > last {
+		return nil, errUnknownBlock
+	}
+	var blocks []uint64
+	parent := chain.GetHeaderByNumber(first - 1)
+	for n := first; n <= last; n++ {
+		header := chain.GetHeaderByNumber(n)
+		if header == nil || parent == nil || header.ParentHash != parent.Hash() {
+			return nil, errUnknownBlock
+		}
+		expected, err := c.ActualNextProducer(chain, parent)
+		if err != nil {
+			return nil, err
+		}
+		creator, err := ecrecover(header, c.signatures)
+		if err != nil {
+			return nil, err
+		}
+		if creator != expected {
+			blocks = append(blocks, n)
+		}
+		parent = header
+	}
+	return blocks, nil
+}
+
+// VerifyEpochDoubleValidation audits the double validation of the blocks of an
+// epoch, up to the head of the chain. It returns the numbers of the blocks whose
+// validator signature doesn't recover to the validator assigned to its creator,
+// or which carry no valid validator signature at all.
+func (c *XDPoS) VerifyEpochDoubleValidation(chain consensus.ChainReader, epochNumber uint64) ([]uint64, error) {
+	head := chain.CurrentHeader()
+	if head == nil {
+		return nil, errUnknownBlock
+	}
+	first, last := epochNumber*c.config.Epoch, (epochNumber+1)*c.config.Epoch-1
+	if last > head.Number.Uint64() {
+		last = head.Number.Uint64()
+	}
+	if first > last {
+		return nil, errUnknownBlock
+	}
+	var blocks []uint64
+	for n := first; n <= last; n++ {
+		if !c.isDoubleValidated(n) {
+			continue
+		}
+		header := chain.GetHeaderByNumber(n)
+		if header == nil {
+			return nil, errUnknownBlock
+		}
+		creator, err := ecrecover(header, c.signatures)
+		if err != nil {
+			return nil, err
+		}
+		assigned, err := c.GetValidator(creator, chain, header)
+		if err != nil {
+			return nil, err
+		}
+		if validator, err := c.RecoverValidator(header); err != nil || validator != assigned {
+			blocks = append(blocks, n)
+		}
+	}
+	return blocks, nil
+}
+
+// VerifyEpochTiming checks that the time spanned by the blocks of an epoch, up
+// to the head of the chain, matches the block period within the tolerance. This
+// catches widespread timestamp manipulation or stalls that the check of every
+// block against its parent lets through.
+func (c *XDPoS) VerifyEpochTiming(chain consensus.ChainReader, epochNumber uint64, tolerance time.Duration) error {
+	head := chain.CurrentHeader()
+	if head == nil {
+		return errUnknownBlock
 	}
-	var parent *types.Header
-	if len(parents) > 0 {
-		parent = parents[len(parents)-1]
-	} else {
-		parent = chain.GetHeader(header.ParentHash, number-1)
+	first, last := epochNumber*c.config.Epoch, (epochNumber+1)*c.config.Epoch-1
+	if last > head.Number.Uint64() {
+		last = head.Number.Uint64()
 	}
-	difficulty := c.calcDifficulty(chain, parent, creator)
-	log.Debug("verify seal block", "number", header.Number, "hash", header.Hash(), "block difficulty", header.Difficulty, "calc difficulty", difficulty, "creator", creator)
-	// Ensure that the block's difficulty is meaningful (may not be correct at this point)
-	if number > 0 {
-		if header.Difficulty.Int64() != difficulty.Int64() {
-			return errInvalidDifficulty
-		}
+	if first > last {
+		return errUnknownBlock
 	}
-	masternodes := c.GetMasternodes(chain, header)
-	mstring := []string{}
-	for _, m := range masternodes {
-		mstring = append(mstring, m.String())
+	firstHeader, lastHeader := chain.GetHeaderByNumber(first), chain.GetHeaderByNumber(last)
+	if firstHeader == nil || lastHeader == nil {
+		return errUnknownBlock
 	}
-	nstring := []string{}
-	for _, n := range snap.GetSigners() {
-		nstring = append(nstring, n.String())
+	span := time.Duration(new(big.Int).Sub(lastHeader.Time, firstHeader.Time).Int64()) * time.Second
+	expected := time.Duration((last-first)*c.GetPeriod()) * time.Second
+	if deviation := span - expected; deviation > tolerance || -deviation > tolerance {
+		return fmt.Errorf("epoch %d spans %v, expected %v: %v", epochNumber, span, expected, ErrEpochTimingDeviation)
 	}
-	if _, ok := snap.Signers[creator]; !ok {
-		valid := false
-		for _, m := range masternodes {
-			if m == creator {
-				valid = true
-				break
-			}
+	return nil
+}
+
+// VerifyRotationSegment checks the producer rotation of the blocks between from
+// and to, both ends included: every block must be sealed by a masternode of its
+// epoch, and carry the difficulty matching the position of its creator relative
+// to the creator of its parent. The first offending block is reported.
+func (c *XDPoS) VerifyRotationSegment(chain consensus.ChainReader, from, to uint64) error {
+	if from == 0 {
+		// The genesis block isn't produced by anyone
+		from = 1
+	}
+	parent := chain.GetHeaderByNumber(from - 1)
+	if parent == nil {
+		return errUnknownBlock
+	}
+	for n := from; n <= to; n++ {
+		header := chain.GetHeaderByNumber(n)
+		if header == nil || header.ParentHash != parent.Hash() {
+			return fmt.Errorf("block %d: %v", n, errUnknownBlock)
 		}
-		if !valid {
-			log.Debug("Unauthorized creator found", "block number", number, "creator", creator.String(), "masternodes", mstring, "snapshot from parent block", nstring)
-			return errUnauthorized
+		creator, err := ecrecover(header, c.signatures)
+		if err != nil {
+			return fmt.Errorf("block %d: %v", n, err)
 		}
-	}
-	if len(masternodes) > 1 {
-		for seen, recent := range snap.Recents {
-			if recent == creator {
-				// Signer is among recents, only fail if the current block doesn't shift it out
-				// There is only case that we don't allow signer to create two continuous blocks.
-				if limit := uint64(2); seen > number-limit {
-					// Only take into account the non-epoch blocks
-					if number%c.config.Epoch != 0 {
-						return errUnauthorized
-					}
-				}
-			}
+		if position(c.GetMasternodes(chain, header), creator) < 0 {
+			return fmt.Errorf("block %d: %v", n, errUnauthorized)
 		}
+		if header.Difficulty.Cmp(c.calcDifficulty(chain, parent, creator)) != 0 {
+			return fmt.Errorf("block %d: %v", n, errInvalidDifficulty)
+		}
+		parent = header
 	}
+	return nil
+}
 
-	// header must contain validator info following double validation design
-	// start checking from epoch 2nd.
-	if header.Number.Uint64() > c.config.Epoch && fullVerify {
-		validator, err := c.RecoverValidator(header)
-		if err != nil {
-			return err
+// ProducersInRange returns the creators of the blocks between from and to, both
+// ends included, keyed by block number. The genesis block isn't produced by
+// anyone and is left out. At most maxProducersRange blocks are collected at once.
+func (c *XDPoS) ProducersInRange(chain consensus.ChainReader, from, to uint64) (map[uint64]common.Address, error) {
+	if from == 0 {
+		from = 1
+	}
+	if from > to {
+		return nil, errUnknownBlock
+	}
+	if to-from >= maxProducersRange {
+		return nil, errRangeTooLarge
+	}
+	producers := make(map[uint64]common.Address, to-from+1)
+	for n := from; n <= to; n++ {
+		header := chain.GetHeaderByNumber(n)
+		if header == nil {
+			return nil, fmt.Errorf("block %d: %v", n, errUnknownBlock)
 		}
-
-		// verify validator
-		assignedValidator, err := c.GetValidator(creator, chain, header)
+		creator, err := ecrecover(header, c.signatures)
 		if err != nil {
-			return err
-		}
-		if validator != assignedValidator {
-			log.Debug("Bad block detected. Header contains wrong pair of creator-validator", "creator", creator, "assigned validator", assignedValidator, "wrong validator", validator)
-			return errFailedDoubleValidation
+			return nil, fmt.Errorf("block %d: %v", n, err)
 		}
+		producers[n] = creator
+	}
+	return producers, nil
+}
+
+// verifyValidator checks that the validator recovered from a header is the one
+// assigned to its creator, and that it is a masternode of the epoch at all in
+// case the creator-validator assignment is corrupted.
+func verifyValidator(validator, assigned common.Address, masternodes []common.Address) error {
+	if validator != assigned {
+		return errFailedDoubleValidation
+	}
+	if position(masternodes, validator) < 0 {
+		return ErrValidatorNotMasternode
 	}
 	return nil
 }
 
+// isDoubleValidated returns whether the block at the given number must carry a
+// validator signature. Double validation starts from the second epoch, the
+// first checkpoint block itself is still produced without one.
+func (c *XDPoS) isDoubleValidated(number uint64) bool {
+	return number > c.config.Epoch
+}
+
+// penaltyHook returns the penalty hook matching the fork rules the header was
+// produced under, or nil if that hook isn't set.
+func (c *XDPoS) penaltyHook(chain consensus.ChainReader, header *types.Header) func(chain consensus.ChainReader, header *types.Header, candidates []common.Address) ([]common.Address, error) {
+	if chain.Config().IsTIPSigning(header.Number) {
+		return c.HookPenaltyTIPSigning
+	}
+	if c.HookPenalty == nil {
+		return nil
+	}
+	return func(chain consensus.ChainReader, header *types.Header, candidates []common.Address) ([]common.Address, error) {
+		return c.HookPenalty(chain, header.Number.Uint64())
+	}
+}
+
+// GetValidator returns the validator assigned to double validate the blocks of
+// the creator. Blocks of the first epoch have no validator assigned, for which
+// ErrNoValidatorBeforeFirstEpoch is returned.
 func (c *XDPoS) GetValidator(creator common.Address, chain consensus.ChainReader, header *types.Header) (common.Address, error) {
-	epoch := c.config.Epoch
 	no := header.Number.Uint64()
-	cpNo := no
-	if no%epoch != 0 {
-		cpNo = no - (no % epoch)
-	}
-	if cpNo == 0 {
-		return common.Address{}, nil
+	if no < c.config.Epoch {
+		return common.Address{}, ErrNoValidatorBeforeFirstEpoch
 	}
-	cpHeader := chain.GetHeaderByNumber(cpNo)
-	if cpHeader == nil {
-		if no%epoch == 0 {
-			cpHeader = header
-		} else {
-			return common.Address{}, fmt.Errorf("couldn't find checkpoint header")
+	cpHeader, err := c.CheckpointHeaderFor(chain, no)
+	if err != nil {
+		if no%c.config.Epoch != 0 {
+			return common.Address{}, err
 		}
+		cpHeader = header
 	}
 	m, err := GetM1M2FromCheckpointHeader(cpHeader, header, chain.Config())
 	if err != nil {
@@ -813,14 +2366,8 @@ func (c *XDPoS) Prepare(chain consensus.ChainReader, header *types.Header) error
 	header.Extra = header.Extra[:extraVanity]
 	masternodes := snap.GetSigners()
 	if number >= c.config.Epoch && number%c.config.Epoch == 0 {
-		if c.HookPenalty != nil || c.HookPenaltyTIPSigning != nil {
-			var penMasternodes []common.Address = nil
-			var err error = nil
-			if chain.Config().IsTIPSigning(header.Number) {
-				penMasternodes, err = c.HookPenaltyTIPSigning(chain, header, masternodes)
-			} else {
-				penMasternodes, err = c.HookPenalty(chain, number)
-			}
+		if hook := c.penaltyHook(chain, header); hook != nil {
+			penMasternodes, err := hook(chain, header, masternodes)
 			if err != nil {
 				return err
 			}
@@ -830,18 +2377,20 @@ func (c *XDPoS) Prepare(chain consensus.ChainReader, header *types.Header) error
 				for _, address := range penMasternodes {
 					log.Debug("Penalty status", "address", address, "number", number)
 				}
-				header.Penalties = common.ExtractAddressToBytes(penMasternodes)
+				header.Penalties = common.ExtractAddressToBytes(sortAddresses(penMasternodes))
 			}
 		}
 		// Prevent penalized masternode(s) within 4 recent epochs
-		for i := 1; i <= common.LimitPenaltyEpoch; i++ {
-			if number > uint64(i)*c.config.Epoch {
-				masternodes = RemovePenaltiesFromBlock(chain, masternodes, number-uint64(i)*c.config.Epoch)
-			}
+		masternodes = c.removeRecentPenalties(chain, masternodes, number)
+		if chain.Config().IsShuffleMasternodes(header.Number) {
+			masternodes = shuffleMasternodes(masternodes, header.ParentHash)
 		}
 		for _, masternode := range masternodes {
 			header.Extra = append(header.Extra, masternode[:]...)
 		}
+		if c.LogMasternodes {
+			log.Info("Masternodes of new epoch", "number", number, "masternodes", masternodes, "penalties", common.ExtractAddressFromBytes(header.Penalties))
+		}
 		if c.HookValidator != nil {
 			validators, err := c.HookValidator(header, masternodes)
 			if err != nil {
@@ -857,8 +2406,13 @@ func (c *XDPoS) Prepare(chain consensus.ChainReader, header *types.Header) error
 
 	// Ensure the timestamp has the correct delay
 
-	header.Time = new(big.Int).Add(parent.Time, new(big.Int).SetUint64(c.config.Period))
+	header.Time = new(big.Int).Add(parent.Time, new(big.Int).SetUint64(c.sealingPeriod()))
 	if header.Time.Int64() < time.Now().Unix() {
+		// The slot has passed, either catch up with the current time or refuse
+		// to produce a block out of its slot on strictly timed chains
+		if c.StrictBlockTime {
+			return errSlotPassed
+		}
 		header.Time = big.NewInt(time.Now().Unix())
 	}
 	return nil
@@ -872,17 +2426,30 @@ func (c *XDPoS) UpdateMasternodes(chain consensus.ChainReader, header *types.Hea
 	if err != nil {
 		return err
 	}
+	oldMasternodes := snap.GetSigners()
 	newMasternodes := make(map[common.Address]struct{})
+	addresses := make([]common.Address, 0, len(ms))
 	for _, m := range ms {
+		if _, ok := newMasternodes[m.Address]; !ok {
+			addresses = append(addresses, m.Address)
+		}
 		newMasternodes[m.Address] = struct{}{}
 	}
+	// Reject the new set before touching the snapshot
+	if err := verifyRecentSignerLimit(c.config.RecentSignerLimit, addresses); err != nil {
+		return err
+	}
 	snap.Signers = newMasternodes
 	nm := []string{}
 	for _, n := range ms {
 		nm = append(nm, n.Address.String())
 	}
+	c.forgetDifficulties(snap.Hash)
 	c.recents.Add(snap.Hash, snap)
 	log.Info("New set of masternodes has been updated to snapshot", "number", snap.Number, "hash", snap.Hash, "new masternodes", nm)
+	if c.OnMasternodeSetChange != nil {
+		c.OnMasternodeSetChange(oldMasternodes, snap.GetSigners())
+	}
 	return nil
 }
 
@@ -901,13 +2468,7 @@ func (c *XDPoS) Finalize(chain consensus.ChainReader, header *types.Header, stat
 			return nil, err
 		}
 		if len(common.StoreRewardFolder) > 0 {
-			data, err := json.Marshal(rewards)
-			if err == nil {
-				err = ioutil.WriteFile(filepath.Join(common.StoreRewardFolder, header.Number.String()+"."+header.Hash().Hex()), data, 0644)
-			}
-			if err != nil {
-				log.Error("Error when save reward info ", "number", header.Number, "hash", header.Hash().Hex(), "err", err)
-			}
+			c.rewards.save(types.CopyHeader(header), rewards, c.RewardQueueSize)
 		}
 	}
 
@@ -929,6 +2490,37 @@ func (c *XDPoS) Authorize(signer common.Address, signFn clique.SignerFn) {
 	c.signFn = signFn
 }
 
+// CanSign checks that a signer is authorized together with a signing function
+// actually producing its signatures, so that a misconfigured signer is detected
+// before the first block is due to be sealed.
+func (c *XDPoS) CanSign() error {
+	c.lock.RLock()
+	signer, signFn := c.signer, c.signFn
+	c.lock.RUnlock()
+
+	if signer == (common.Address{}) {
+		return errNoSigner
+	}
+	if signFn == nil {
+		return errNoSignFn
+	}
+	hash := crypto.Keccak256([]byte("XDPoS signer check"))
+	sig, err := signFn(accounts.Account{Address: signer}, hash)
+	if err != nil {
+		return err
+	}
+	pubkey, err := crypto.Ecrecover(hash, sig)
+	if err != nil {
+		return err
+	}
+	var recovered common.Address
+	copy(recovered[:], crypto.Keccak256(pubkey[1:])[12:])
+	if recovered != signer {
+		return fmt.Errorf("sign function signs for %x instead of %x", recovered, signer)
+	}
+	return nil
+}
+
 // Seal implements consensus.Engine, attempting to create a sealed block using
 // the local signing credentials.
 func (c *XDPoS) Seal(chain consensus.ChainReader, block *types.Block, stop <-chan struct{}) (*types.Block, error) {
@@ -941,7 +2533,7 @@ func (c *XDPoS) Seal(chain consensus.ChainReader, block *types.Block, stop <-cha
 	}
 	// For 0-period chains, refuse to seal empty blocks (no reward but would spin sealing)
 	// checkpoint blocks have no tx
-	if c.config.Period == 0 && len(block.Transactions()) == 0 && number%c.config.Epoch != 0 {
+	if c.sealingPeriod() == 0 && len(block.Transactions()) == 0 && number%c.config.Epoch != 0 {
 		return nil, errWaitTransactions
 	}
 	// Don't hold the signer fields for the entire sealing procedure
@@ -950,40 +2542,14 @@ func (c *XDPoS) Seal(chain consensus.ChainReader, block *types.Block, stop <-cha
 	c.lock.RUnlock()
 
 	// Bail out if we're unauthorized to sign a block
-	snap, err := c.snapshot(chain, number-1, header.ParentHash, nil)
+	recent, err := c.authorizeSeal(chain, header, signer)
 	if err != nil {
 		return nil, err
 	}
-	masternodes := c.GetMasternodes(chain, header)
-	if _, authorized := snap.Signers[signer]; !authorized {
-		valid := false
-		for _, m := range masternodes {
-			if m == signer {
-				valid = true
-				break
-			}
-		}
-		if !valid {
-			return nil, errUnauthorized
-		}
-	}
 	// If we're amongst the recent signers, wait for the next block
-	// only check recent signers if there are more than one signer.
-	if len(masternodes) > 1 {
-		for seen, recent := range snap.Recents {
-			if recent == signer {
-				// Signer is among recents, only wait if the current block doesn't shift it out
-				// There is only case that we don't allow signer to create two continuous blocks.
-				if limit := uint64(2); number < limit || seen > number-limit {
-					// Only take into account the non-epoch blocks
-					if number%c.config.Epoch != 0 {
-						log.Info("Signed recently, must wait for others ", "len(masternodes)", len(masternodes), "number", number, "limit", limit, "seen", seen, "recent", recent.String(), "snap.Recents", snap.Recents)
-						<-stop
-						return nil, nil
-					}
-				}
-			}
-		}
+	if recent {
+		<-stop
+		return nil, nil
 	}
 	select {
 	case <-stop:
@@ -997,6 +2563,9 @@ func (c *XDPoS) Seal(chain consensus.ChainReader, block *types.Block, stop <-cha
 	}
 	copy(header.Extra[len(header.Extra)-extraSeal:], sighash)
 	m2, err := c.GetValidator(signer, chain, header)
+	if err == ErrNoValidatorBeforeFirstEpoch {
+		return block.WithSeal(header), nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("can't get block validator: %v", err)
 	}
@@ -1006,6 +2575,63 @@ func (c *XDPoS) Seal(chain consensus.ChainReader, block *types.Block, stop <-cha
 	return block.WithSeal(header), nil
 }
 
+// authorizeSeal checks whether the signer is allowed to seal the header, and
+// whether it has to wait for others to seal the next block as it signed recently.
+func (c *XDPoS) authorizeSeal(chain consensus.ChainReader, header *types.Header, signer common.Address) (bool, error) {
+	number := header.Number.Uint64()
+	snap, err := c.snapshot(chain, number-1, header.ParentHash, nil)
+	if err != nil {
+		return false, err
+	}
+	masternodes := c.GetMasternodes(chain, header)
+	if _, authorized := snap.Signers[signer]; !authorized {
+		valid := false
+		for _, m := range masternodes {
+			if m == signer {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return false, errUnauthorized
+		}
+	}
+	// only check recent signers if there are more than one signer.
+	c.lock.RLock()
+	limit := c.sealSignerLimit
+	c.lock.RUnlock()
+	if c.signedRecently(snap, masternodes, signer, number, limit) {
+		log.Info("Signed recently, must wait for others ", "len(masternodes)", len(masternodes), "number", number, "signer", signer.String(), "snap.Recents", snap.Recents)
+		return true, nil
+	}
+	return false, nil
+}
+
+// DryRunSeal runs the checks of Seal without signing anything, to confirm the
+// local signer is positioned to produce blocks. It returns the header the block
+// would be sealed with, unsigned, and whether it would be sealed now rather than
+// waiting for others as the signer signed recently.
+func (c *XDPoS) DryRunSeal(chain consensus.ChainReader, block *types.Block) (*types.Header, bool, error) {
+	header := block.Header()
+
+	number := header.Number.Uint64()
+	if number == 0 {
+		return nil, false, errUnknownBlock
+	}
+	if c.sealingPeriod() == 0 && len(block.Transactions()) == 0 && number%c.config.Epoch != 0 {
+		return nil, false, errWaitTransactions
+	}
+	c.lock.RLock()
+	signer := c.signer
+	c.lock.RUnlock()
+
+	recent, err := c.authorizeSeal(chain, header, signer)
+	if err != nil {
+		return nil, false, err
+	}
+	return header, !recent, nil
+}
+
 // CalcDifficulty is the difficulty adjustment algorithm. It returns the difficulty
 // that a new block should have based on the previous blocks in the chain and the
 // current signer.
@@ -1014,11 +2640,97 @@ func (c *XDPoS) CalcDifficulty(chain consensus.ChainReader, time uint64, parent
 }
 
 func (c *XDPoS) calcDifficulty(chain consensus.ChainReader, parent *types.Header, signer common.Address) *big.Int {
-	len, preIndex, curIndex, _, err := c.YourTurn(chain, parent, signer)
+	return c.CalcDifficultyDetail(chain, parent, signer).Difficulty
+}
+
+// DifficultyDetail is the breakdown of the difficulty of a block sealed by a
+// signer on top of a parent.
+type DifficultyDetail struct {
+	Masternodes int      `json:"masternodes"` // Number of masternodes of the epoch
+	PreIndex    int      `json:"preIndex"`    // Position of the creator of the parent
+	CurIndex    int      `json:"curIndex"`    // Position of the signer
+	Hop         int      `json:"hop"`         // Number of masternodes skipped since the parent's creator
+	Difficulty  *big.Int `json:"difficulty"`  // Resulting difficulty
+}
+
+// difficultyKey identifies a difficulty cached for a signer on top of a parent,
+// along with the checkpoint the masternodes were read from. The checkpoint is
+// looked up by number on the canonical chain, which a reorg can replace.
+type difficultyKey struct {
+	checkpoint common.Hash
+	signer     common.Address
+}
+
+// parentDifficulties holds the difficulties cached on top of a parent block.
+type parentDifficulties struct {
+	lock    sync.Mutex
+	details map[difficultyKey]*DifficultyDetail
+}
+
+// CalcDifficultyDetail computes the difficulty of a block sealed by the signer
+// on top of the parent, together with the components it derives from.
+func (c *XDPoS) CalcDifficultyDetail(chain consensus.ChainReader, parent *types.Header, signer common.Address) *DifficultyDetail {
+	checkpoint := parent
+	if number := parent.Number.Uint64(); number%c.config.Epoch != 0 {
+		checkpoint, _ = c.CheckpointHeaderFor(chain, number)
+	}
+	var key difficultyKey
+	if checkpoint != nil {
+		key = difficultyKey{checkpoint: checkpoint.Hash(), signer: signer}
+		if cached, ok := c.difficulties.Get(parent.Hash()); ok {
+			difficulties := cached.(*parentDifficulties)
+			difficulties.lock.Lock()
+			cached, ok := difficulties.details[key]
+			difficulties.lock.Unlock()
+			if ok {
+				detail := *cached
+				detail.Difficulty = new(big.Int).Set(detail.Difficulty)
+				return &detail
+			}
+		}
+	}
+	len, preIndex, curIndex, _, err := c.yourTurn(chain, parent, signer, false)
+	detail := &DifficultyDetail{Masternodes: len, PreIndex: preIndex, CurIndex: curIndex}
 	if err != nil {
-		return big.NewInt(int64(len + curIndex - preIndex))
+		detail.Difficulty = big.NewInt(int64(len + curIndex - preIndex))
+		return detail
+	}
+	detail.Hop = Hop(len, preIndex, curIndex)
+	detail.Difficulty = big.NewInt(int64(len - detail.Hop))
+
+	if checkpoint != nil {
+		// Added only once computed, as computing the snapshot may forget the
+		// difficulties of the parent
+		var difficulties *parentDifficulties
+		if cached, ok := c.difficulties.Peek(parent.Hash()); ok {
+			difficulties = cached.(*parentDifficulties)
+		} else {
+			difficulties = &parentDifficulties{details: make(map[difficultyKey]*DifficultyDetail)}
+			c.difficulties.Add(parent.Hash(), difficulties)
+		}
+		entry := *detail
+		entry.Difficulty = new(big.Int).Set(detail.Difficulty)
+		difficulties.lock.Lock()
+		difficulties.details[key] = &entry
+		difficulties.lock.Unlock()
 	}
-	return big.NewInt(int64(len - Hop(len, preIndex, curIndex)))
+	return detail
+}
+
+// forgetDifficulties drops the cached difficulties of the blocks on top of the
+// given one, as the snapshot they were derived from changed.
+func (c *XDPoS) forgetDifficulties(parent common.Hash) {
+	c.difficulties.Remove(parent)
+}
+
+// VerifyDifficultyRange checks that the difficulty of a header lies within the
+// bounds the hop formula can produce for the given number of masternodes, which
+// filters out impossible values without needing the parent.
+func VerifyDifficultyRange(header *types.Header, masternodeCount int) error {
+	if header.Difficulty == nil || header.Difficulty.Cmp(common.Big1) < 0 || header.Difficulty.Cmp(big.NewInt(int64(masternodeCount))) > 0 {
+		return errInvalidDifficulty
+	}
+	return nil
 }
 
 // APIs implements consensus.Engine, returning the user facing RPC API to allow
@@ -1074,9 +2786,93 @@ func (c *XDPoS) GetMasternodesFromCheckpointHeader(preCheckpointHeader *types.He
 }
 
 func (c *XDPoS) CacheData(header *types.Header, txs []*types.Transaction, receipts []*types.Receipt) []*types.Transaction {
+	signTxs := c.signingTransactions(txs, receipts)
+
+	log.Debug("Save tx signers to cache", "hash", header.Hash().String(), "number", header.Number, "len(txs)", len(signTxs))
+	c.BlockSigners.Add(header.Hash(), signTxs)
+
+	return signTxs
+}
+
+// VerifyBlockIntegrity checks that the transaction and uncle roots of the header
+// match the body of the block, and that its bloom and receipt root match the
+// receipts of the block, giving tooling a single entry point to validate blocks
+// beyond their consensus fields.
+func (c *XDPoS) VerifyBlockIntegrity(block *types.Block, receipts types.Receipts) error {
+	header := block.Header()
+	if hash := types.CalcUncleHash(block.Uncles()); hash != header.UncleHash {
+		return fmt.Errorf("uncle root hash mismatch: have %x, want %x", hash, header.UncleHash)
+	}
+	if hash := types.DeriveSha(block.Transactions()); hash != header.TxHash {
+		return fmt.Errorf("transaction root hash mismatch: have %x, want %x", hash, header.TxHash)
+	}
+	if bloom := types.CreateBloom(receipts); bloom != header.Bloom {
+		return fmt.Errorf("invalid bloom (remote: %x  local: %x)", header.Bloom, bloom)
+	}
+	if hash := types.DeriveSha(receipts); hash != header.ReceiptHash {
+		return fmt.Errorf("invalid receipt root hash (remote: %x local: %x)", header.ReceiptHash, hash)
+	}
+	return nil
+}
+
+// VerifySigningTransactions checks at reward checkpoints that the signing
+// transactions the rewards are computed from include every signing transaction
+// of the reward window which succeeded, according to the receipts. The expected
+// set is derived from the block bodies and receipts, and compared against the
+// BlockSigners cache the rewards read, blocks missing from the cache being read
+// again by the reward computation rather than checked. Entries cached without
+// receipts may hold failed signing transactions as well, which are ignored.
+func (c *XDPoS) VerifySigningTransactions(chain consensus.ChainReader, header *types.Header, getReceipts func(hash common.Hash) types.Receipts) error {
+	number := header.Number.Uint64()
+	rCheckpoint := c.config.RewardCheckpoint
+	if rCheckpoint == 0 || number == 0 || number%rCheckpoint != 0 {
+		return nil
+	}
+	// The rewards read the signing transactions of the blocks since the
+	// checkpoint preceding the rewarded one
+	first := uint64(1)
+	if number > 2*rCheckpoint {
+		first = number - 2*rCheckpoint + 1
+	}
+	for n := number - 1; n >= first; n-- {
+		parent := chain.GetHeader(header.ParentHash, n)
+		if parent == nil {
+			return consensus.ErrUnknownAncestor
+		}
+		header = parent
+
+		cached, ok := c.BlockSigners.Get(header.Hash())
+		if !ok {
+			continue
+		}
+		block := chain.GetBlock(header.Hash(), n)
+		if block == nil {
+			return errUnknownBlock
+		}
+		receipts := getReceipts(header.Hash())
+		if len(receipts) != len(block.Transactions()) {
+			return fmt.Errorf("block %d: missing receipts", n)
+		}
+		rewarded := make(map[common.Hash]struct{})
+		for _, tx := range cached.([]*types.Transaction) {
+			rewarded[tx.Hash()] = struct{}{}
+		}
+		for _, tx := range c.signingTransactions(block.Transactions(), receipts) {
+			if _, ok := rewarded[tx.Hash()]; !ok {
+				log.Debug("Signing transaction missing at reward checkpoint", "number", number, "block", n, "tx", tx.Hash().Hex())
+				return ErrMissingSigningTx
+			}
+		}
+	}
+	return nil
+}
+
+// signingTransactions returns the signing transactions of a block which didn't
+// fail according to their receipts.
+func (c *XDPoS) signingTransactions(txs []*types.Transaction, receipts []*types.Receipt) []*types.Transaction {
 	signTxs := []*types.Transaction{}
 	for _, tx := range txs {
-		if tx.IsSigningTransaction() {
+		if c.IsSigningTx(tx) {
 			var b uint
 			for _, r := range receipts {
 				if r.TxHash == tx.Hash() {
@@ -1096,17 +2892,13 @@ func (c *XDPoS) CacheData(header *types.Header, txs []*types.Transaction, receip
 			signTxs = append(signTxs, tx)
 		}
 	}
-
-	log.Debug("Save tx signers to cache", "hash", header.Hash().String(), "number", header.Number, "len(txs)", len(signTxs))
-	c.BlockSigners.Add(header.Hash(), signTxs)
-
 	return signTxs
 }
 
 func (c *XDPoS) CacheSigner(hash common.Hash, txs []*types.Transaction) []*types.Transaction {
 	signTxs := []*types.Transaction{}
 	for _, tx := range txs {
-		if tx.IsSigningTransaction() {
+		if c.IsSigningTx(tx) {
 			signTxs = append(signTxs, tx)
 		}
 	}
@@ -1115,6 +2907,95 @@ func (c *XDPoS) CacheSigner(hash common.Hash, txs []*types.Transaction) []*types
 	return signTxs
 }
 
+// SigningTxCounts tallies the signing transactions sent by each masternode of
+// an epoch within its blocks, up to the head of the chain, to find out who is at
+// risk of being penalised. The signing transactions are taken from the block
+// signers cache, or from the blocks themselves when missing.
+func (c *XDPoS) SigningTxCounts(chain consensus.ChainReader, epochNumber uint64) (map[common.Address]int, error) {
+	head := chain.CurrentHeader()
+	if head == nil {
+		return nil, errUnknownBlock
+	}
+	first, last := epochNumber*c.config.Epoch, (epochNumber+1)*c.config.Epoch-1
+	if last > head.Number.Uint64() {
+		last = head.Number.Uint64()
+	}
+	if first > last {
+		return nil, errUnknownBlock
+	}
+	checkpoint := chain.GetHeaderByNumber(first)
+	if checkpoint == nil {
+		return nil, errUnknownBlock
+	}
+	counts := make(map[common.Address]int)
+	for _, masternode := range c.GetMasternodes(chain, checkpoint) {
+		counts[masternode] = 0
+	}
+	for n := first; n <= last; n++ {
+		header := chain.GetHeaderByNumber(n)
+		if header == nil {
+			return nil, errUnknownBlock
+		}
+		var txs []*types.Transaction
+		if cached, ok := c.BlockSigners.Get(header.Hash()); ok {
+			txs = cached.([]*types.Transaction)
+		} else {
+			block := chain.GetBlock(header.Hash(), n)
+			if block == nil {
+				return nil, errUnknownBlock
+			}
+			for _, tx := range block.Transactions() {
+				if c.IsSigningTx(tx) {
+					txs = append(txs, tx)
+				}
+			}
+		}
+		for _, tx := range txs {
+			from := tx.From()
+			if from == nil {
+				continue
+			}
+			if _, ok := counts[*from]; ok {
+				counts[*from]++
+			}
+		}
+	}
+	return counts, nil
+}
+
+// ValidateBlockSignersCache checks the cached signing transactions of a block
+// against the block contents, to detect stale entries e.g. left by a reorg. As
+// failed signing transactions are left out of the cache according to receipts,
+// which aren't available here, the cache must be a subset of the signing
+// transactions of the block rather than equal to them.
+func (c *XDPoS) ValidateBlockSignersCache(chain consensus.ChainReader, hash common.Hash) error {
+	cached, ok := c.BlockSigners.Get(hash)
+	if !ok {
+		return nil
+	}
+	header := chain.GetHeaderByHash(hash)
+	if header == nil {
+		return errUnknownBlock
+	}
+	block := chain.GetBlock(hash, header.Number.Uint64())
+	if block == nil {
+		return errUnknownBlock
+	}
+	included := make(map[common.Hash]struct{})
+	for _, tx := range block.Transactions() {
+		if c.IsSigningTx(tx) {
+			included[tx.Hash()] = struct{}{}
+		}
+	}
+	for _, tx := range cached.([]*types.Transaction) {
+		if _, ok := included[tx.Hash()]; !ok {
+			log.Warn("Cached signing transaction not in block", "number", header.Number, "hash", hash.Hex(), "tx", tx.Hash().Hex())
+			return errBlockSignersMismatch
+		}
+	}
+	return nil
+}
+
 func (c *XDPoS) GetDb() ethdb.Database {
 	return c.db
 }
@@ -1206,3 +3087,18 @@ func Hop(len, pre, cur int) int {
 		return len - 1
 	}
 }
+
+// MaxBlocksPerMasternode returns the upper bound of the blocks a masternode can
+// produce within an epoch of the given length. A lone masternode seals every
+// block, otherwise no masternode may seal two consecutive blocks of an epoch, so
+// it can at best seal every other block, starting from the checkpoint.
+func MaxBlocksPerMasternode(masternodeCount int, epochLength uint64) uint64 {
+	switch {
+	case masternodeCount <= 0:
+		return 0
+	case masternodeCount == 1:
+		return epochLength
+	default:
+		return (epochLength + 1) / 2
+	}
+}
@@ -1,15 +1,174 @@
 package XDPoS
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/params"
 )
 
+// testChainReader is a consensus.ChainReader backed by an in-memory list of
+// headers, indexed by their block number, and optional side chain headers only
+// reachable by hash.
+type testChainReader struct {
+	config  *params.ChainConfig
+	headers []*types.Header
+	side    []*types.Header
+}
+
+func (r *testChainReader) Config() *params.ChainConfig { return r.config }
+
+func (r *testChainReader) CurrentHeader() *types.Header {
+	if len(r.headers) == 0 {
+		return nil
+	}
+	return r.headers[len(r.headers)-1]
+}
+
+func (r *testChainReader) GetHeader(hash common.Hash, number uint64) *types.Header {
+	header := r.GetHeaderByNumber(number)
+	if header != nil && header.Hash() == hash {
+		return header
+	}
+	for _, header := range r.side {
+		if header.Number.Uint64() == number && header.Hash() == hash {
+			return header
+		}
+	}
+	return nil
+}
+
+func (r *testChainReader) GetHeaderByNumber(number uint64) *types.Header {
+	if number >= uint64(len(r.headers)) {
+		return nil
+	}
+	return r.headers[number]
+}
+
+func (r *testChainReader) GetHeaderByHash(hash common.Hash) *types.Header {
+	for _, header := range r.headers {
+		if header.Hash() == hash {
+			return header
+		}
+	}
+	return nil
+}
+
+func (r *testChainReader) GetBlock(hash common.Hash, number uint64) *types.Block {
+	header := r.GetHeader(hash, number)
+	if header == nil {
+		return nil
+	}
+	return types.NewBlockWithHeader(header)
+}
+
+// newTestSigners generates n signing keys ordered by their addresses.
+func newTestSigners(t testing.TB, n int) ([]*ecdsa.PrivateKey, []common.Address) {
+	keys := make([]*ecdsa.PrivateKey, n)
+	for i := range keys {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal("can't generate key", "err", err)
+		}
+		keys[i] = key
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(crypto.PubkeyToAddress(keys[i].PublicKey).Bytes(), crypto.PubkeyToAddress(keys[j].PublicKey).Bytes()) < 0
+	})
+	addrs := make([]common.Address, n)
+	for i, key := range keys {
+		addrs[i] = crypto.PubkeyToAddress(key.PublicKey)
+	}
+	return keys, addrs
+}
+
+// sealTestHeader signs the header with the given key.
+func sealTestHeader(t testing.TB, header *types.Header, key *ecdsa.PrivateKey) {
+	sig, err := crypto.Sign(sigHash(header).Bytes(), key)
+	if err != nil {
+		t.Fatal("can't sign header", "err", err)
+	}
+	copy(header.Extra[len(header.Extra)-extraSeal:], sig)
+}
+
+// newTestChain creates a chain of length blocks on top of a genesis listing the
+// given signers, with the blocks sealed by the signers in turn.
+func newTestChain(t testing.TB, config *params.XDPoSConfig, keys []*ecdsa.PrivateKey, length int) *testChainReader {
+	extra := make([]byte, extraVanity)
+	for _, key := range keys {
+		extra = append(extra, crypto.PubkeyToAddress(key.PublicKey).Bytes()...)
+	}
+	genesis := &types.Header{
+		Number:     big.NewInt(0),
+		Difficulty: big.NewInt(1),
+		Time:       big.NewInt(1544771829),
+		UncleHash:  uncleHash,
+		Extra:      append(extra, make([]byte, extraSeal)...),
+	}
+	chain := &testChainReader{
+		config:  &params.ChainConfig{ChainId: big.NewInt(1), XDPoS: config},
+		headers: []*types.Header{genesis},
+	}
+	for i := 1; i <= length; i++ {
+		parent := chain.headers[i-1]
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     big.NewInt(int64(i)),
+			Difficulty: big.NewInt(int64(len(keys))),
+			Time:       new(big.Int).Add(parent.Time, new(big.Int).SetUint64(config.Period)),
+			UncleHash:  uncleHash,
+			Extra:      make([]byte, extraVanity+extraSeal),
+		}
+		sealTestHeader(t, header, keys[(i-1)%len(keys)])
+		chain.headers = append(chain.headers, header)
+	}
+	return chain
+}
+
+// newTestSigningTx creates a transaction signing block 899.
+func newTestSigningTx(nonce uint64) *types.Transaction {
+	data := append(common.Hex2Bytes(common.HexSignMethod), common.LeftPadBytes(big.NewInt(899).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(common.HexToHash("0x01").Bytes(), 32)...)
+	return types.NewTransaction(nonce, common.HexToAddress(common.BlockSigners), big.NewInt(0), 200000, big.NewInt(0), data)
+}
+
+// testBlockChainReader is a testChainReader additionally serving a single block
+// with its transactions.
+type testBlockChainReader struct {
+	testChainReader
+	block *types.Block
+}
+
+func (r *testBlockChainReader) GetHeaderByHash(hash common.Hash) *types.Header {
+	if r.block.Hash() == hash {
+		return r.block.Header()
+	}
+	return r.testChainReader.GetHeaderByHash(hash)
+}
+
+func (r *testBlockChainReader) GetBlock(hash common.Hash, number uint64) *types.Block {
+	if r.block.Hash() == hash && r.block.NumberU64() == number {
+		return r.block
+	}
+	return r.testChainReader.GetBlock(hash, number)
+}
+
 func TestGetM1M2FromCheckpointHeader(t *testing.T) {
 	masternodes := []common.Address{
 		common.StringToAddress("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"),
@@ -82,3 +241,1961 @@ func TestCompareSignersLists(t *testing.T) {
 		t.Error("Failed with list has only one signer")
 	}
 }
+
+func TestVerifyPenaltiesSubset(t *testing.T) {
+	masternodes := []common.Address{
+		common.StringToAddress("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"),
+		common.StringToAddress("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"),
+		common.StringToAddress("cccccccccccccccccccccccccccccccccccccccc"),
+	}
+	if err := verifyPenaltiesSubset([]common.Address{masternodes[2], masternodes[0]}, masternodes); err != nil {
+		t.Error("penalties of masternodes should be accepted", "err", err)
+	}
+	if err := verifyPenaltiesSubset([]common.Address{}, masternodes); err != nil {
+		t.Error("empty penalties should be accepted", "err", err)
+	}
+	penalties := []common.Address{
+		masternodes[1],
+		common.StringToAddress("dddddddddddddddddddddddddddddddddddddddd"),
+	}
+	if err := verifyPenaltiesSubset(penalties, masternodes); err != ErrPenaltyOfNonMember {
+		t.Error("penalty of non-member should be rejected", "want", ErrPenaltyOfNonMember, "have", err)
+	}
+}
+
+func TestPenaltyEligible(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 10, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 59)
+
+	// The previous checkpoint lists a masternode which left the signers since
+	former := common.StringToAddress("dddddddddddddddddddddddddddddddddddddddd")
+	extra := append(make([]byte, extraVanity), signers[0].Bytes()...)
+	chain.headers[50].Extra = append(append(extra, former.Bytes()...), make([]byte, extraSeal)...)
+
+	// Checkpoint 10 penalised a candidate which comes back at checkpoint 60
+	comeback := common.StringToAddress("eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee")
+	chain.headers[10].Penalties = comeback.Bytes()
+
+	engine := New(config, nil)
+	eligible := engine.penaltyEligible(chain, 60, nil, signers)
+	for _, address := range []common.Address{signers[1], former, comeback} {
+		if err := verifyPenaltiesSubset([]common.Address{address}, eligible); err != nil {
+			t.Error("penalty should be accepted", "address", address, "err", err)
+		}
+	}
+	stranger := common.StringToAddress("ffffffffffffffffffffffffffffffffffffffff")
+	if err := verifyPenaltiesSubset([]common.Address{comeback, stranger}, eligible); err != ErrPenaltyOfNonMember {
+		t.Error("penalty of non-member should be rejected", "want", ErrPenaltyOfNonMember, "have", err)
+	}
+	// The candidate isn't coming back yet at the previous checkpoint
+	if err := verifyPenaltiesSubset([]common.Address{comeback}, engine.penaltyEligible(chain, 50, nil, signers)); err != ErrPenaltyOfNonMember {
+		t.Error("penalty of a candidate not coming back should be rejected", "want", ErrPenaltyOfNonMember, "have", err)
+	}
+}
+
+func TestSigningPayload(t *testing.T) {
+	header := &types.Header{
+		ParentHash: common.HexToHash("0x01"),
+		Number:     big.NewInt(901),
+		Difficulty: big.NewInt(2),
+		GasLimit:   8000000,
+		Time:       big.NewInt(1544771829),
+		Extra:      make([]byte, extraVanity+extraSeal),
+	}
+	hash, preimage, err := SigningPayload(header)
+	if err != nil {
+		t.Fatal("can't get signing payload", "err", err)
+	}
+	if hash != SigHash(header) {
+		t.Error("signing payload hash mismatch", "want", SigHash(header), "have", hash)
+	}
+	if crypto.Keccak256Hash(preimage) != hash {
+		t.Error("preimage doesn't hash to the signing hash", "want", hash, "have", crypto.Keccak256Hash(preimage))
+	}
+	header.Extra = make([]byte, extraSeal-1)
+	if _, _, err := SigningPayload(header); err != errMissingSignature {
+		t.Error("short extra data should be rejected", "want", errMissingSignature, "have", err)
+	}
+}
+
+func TestVerifyEmptyCheckpointSigners(t *testing.T) {
+	config := &params.XDPoSConfig{Epoch: 900}
+	chain := &testChainReader{config: &params.ChainConfig{ChainId: big.NewInt(1), XDPoS: config}}
+	header := &types.Header{
+		Number:     big.NewInt(900),
+		Difficulty: big.NewInt(2),
+		Time:       big.NewInt(1544771829),
+		UncleHash:  uncleHash,
+		Extra:      make([]byte, extraVanity+extraSeal),
+	}
+	engine := New(config, nil)
+	if err := engine.verifyHeader(chain, header, nil, false); err != ErrEmptyCheckpointSigners {
+		t.Error("checkpoint without masternodes should be rejected", "want", ErrEmptyCheckpointSigners, "have", err)
+	}
+	engine.Bootstrap = true
+	if err := engine.verifyHeader(chain, header, nil, false); err == ErrEmptyCheckpointSigners {
+		t.Error("checkpoint without masternodes should be accepted while bootstrapping")
+	}
+}
+
+func TestVerifyHeadersNonContiguousBatch(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, _ := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 6)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	batch := []*types.Header{chain.headers[1], chain.headers[2], chain.headers[4], chain.headers[3]}
+	_, results := engine.VerifyHeaders(chain, batch, make([]bool, len(batch)))
+	for i := range batch {
+		err := <-results
+		if i < 2 && err == ErrNonContiguousBatch {
+			t.Error("contiguous prefix should be verified", "index", i)
+		}
+		if i >= 2 && err != ErrNonContiguousBatch {
+			t.Error("reordered header should be rejected", "index", i, "want", ErrNonContiguousBatch, "have", err)
+		}
+	}
+}
+
+func TestForkRuleBoundaries(t *testing.T) {
+	config := &params.XDPoSConfig{Epoch: 900}
+	chain := &testChainReader{config: &params.ChainConfig{ChainId: big.NewInt(1), XDPoS: config}}
+	engine := New(config, nil)
+
+	// Double validation only applies from the second epoch onwards
+	for _, test := range []struct {
+		number    int64
+		validated bool
+	}{{899, false}, {900, false}, {901, true}} {
+		header := &types.Header{
+			Number:     big.NewInt(test.number),
+			Difficulty: big.NewInt(2),
+			Time:       big.NewInt(1544771829),
+			UncleHash:  uncleHash,
+			Extra:      make([]byte, extraVanity+extraSeal),
+		}
+		if test.number%900 == 0 {
+			header.Extra = append(make([]byte, extraVanity+common.AddressLength), make([]byte, extraSeal)...)
+		}
+		err := engine.verifyHeader(chain, header, nil, true)
+		if (err == consensus.ErrNoValidatorSignature) != test.validated {
+			t.Error("wrong double validation gate", "number", test.number, "err", err)
+		}
+	}
+	// Penalties are computed by the hook of the fork era of the checkpoint
+	engine.HookPenalty = func(chain consensus.ChainReader, number uint64) ([]common.Address, error) {
+		return []common.Address{common.StringToAddress("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")}, nil
+	}
+	before := &types.Header{Number: new(big.Int).Sub(common.TIPSigning, big.NewInt(1))}
+	if hook := engine.penaltyHook(chain, before); hook == nil {
+		t.Error("pre TIPSigning penalty hook missing")
+	}
+	after := &types.Header{Number: new(big.Int).Set(common.TIPSigning)}
+	if hook := engine.penaltyHook(chain, after); hook != nil {
+		t.Error("pre TIPSigning penalty hook used after the fork")
+	}
+	engine.HookPenaltyTIPSigning = func(chain consensus.ChainReader, header *types.Header, candidates []common.Address) ([]common.Address, error) {
+		return candidates, nil
+	}
+	hook := engine.penaltyHook(chain, after)
+	if hook == nil {
+		t.Fatal("TIPSigning penalty hook missing")
+	}
+	candidates := []common.Address{common.StringToAddress("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")}
+	if penalties, _ := hook(chain, after, candidates); !reflect.DeepEqual(penalties, candidates) {
+		t.Error("wrong penalty hook used after TIPSigning", "penalties", penalties)
+	}
+}
+
+func TestVerifyValidator(t *testing.T) {
+	masternodes := []common.Address{
+		common.StringToAddress("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"),
+		common.StringToAddress("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"),
+	}
+	outsider := common.StringToAddress("cccccccccccccccccccccccccccccccccccccccc")
+	if err := verifyValidator(masternodes[1], masternodes[1], masternodes); err != nil {
+		t.Error("assigned masternode validator should be accepted", "err", err)
+	}
+	if err := verifyValidator(masternodes[0], masternodes[1], masternodes); err != errFailedDoubleValidation {
+		t.Error("unassigned validator should be rejected", "want", errFailedDoubleValidation, "have", err)
+	}
+	if err := verifyValidator(outsider, outsider, masternodes); err != ErrValidatorNotMasternode {
+		t.Error("validator outside of the masternodes should be rejected", "want", ErrValidatorNotMasternode, "have", err)
+	}
+}
+
+func TestMasternodeJoinedAt(t *testing.T) {
+	config := &params.XDPoSConfig{Epoch: 10}
+	chain := &testChainReader{config: &params.ChainConfig{ChainId: big.NewInt(1), XDPoS: config}}
+
+	veteran := common.StringToAddress("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	newcomer := common.StringToAddress("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	returning := common.StringToAddress("cccccccccccccccccccccccccccccccccccccccc")
+	outsider := common.StringToAddress("dddddddddddddddddddddddddddddddddddddddd")
+	epochs := [][]common.Address{
+		{veteran, returning},
+		{veteran, returning},
+		{veteran},
+		{veteran, newcomer, returning},
+		{veteran, newcomer, returning},
+	}
+	for i := 0; i <= 45; i++ {
+		header := &types.Header{Number: big.NewInt(int64(i)), Extra: make([]byte, extraVanity+extraSeal)}
+		if i%10 == 0 {
+			extra := make([]byte, extraVanity)
+			for _, m := range epochs[i/10] {
+				extra = append(extra, m.Bytes()...)
+			}
+			header.Extra = append(extra, make([]byte, extraSeal)...)
+		}
+		chain.headers = append(chain.headers, header)
+	}
+	engine := New(config, nil)
+	for _, test := range []struct {
+		addr   common.Address
+		from   uint64
+		number uint64
+		found  bool
+	}{
+		{veteran, 0, 0, true},
+		{veteran, 2, 0, false},
+		{newcomer, 0, 30, true},
+		{newcomer, 2, 30, true},
+		{newcomer, 3, 0, false},
+		{returning, 0, 30, true},
+		{outsider, 0, 0, false},
+	} {
+		number, found, err := engine.MasternodeJoinedAt(chain, test.addr, test.from)
+		if err != nil {
+			t.Fatal("can't find joining block", "err", err)
+		}
+		if number != test.number || found != test.found {
+			t.Error("wrong joining block", "addr", test.addr, "from", test.from, "want", test.number, test.found, "have", number, found)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 5)
+	chain := newTestChain(t, config, keys, 5)
+
+	// Move the head into the future so the period isn't overridden by the clock
+	head := chain.CurrentHeader()
+	head.Time = big.NewInt(time.Now().Unix() + 3600)
+	sealTestHeader(t, head, keys[4%len(keys)])
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	if err := engine.ReloadConfig(chain, &params.XDPoSConfig{Period: 10, Epoch: 30, Gap: 5}); err != nil {
+		t.Fatal("can't reload config", "err", err)
+	}
+	header := &types.Header{ParentHash: head.Hash(), Number: big.NewInt(6)}
+	if err := engine.Prepare(chain, header); err != nil {
+		t.Fatal("can't prepare header", "err", err)
+	}
+	if want := new(big.Int).Add(head.Time, big.NewInt(10)); header.Time.Cmp(want) != 0 {
+		t.Error("prepared header doesn't use the reloaded period", "want", want, "have", header.Time)
+	}
+	// Verification keeps following the chain's configuration
+	if engine.GetPeriod() != 2 {
+		t.Error("reload changed the verified period", "want", 2, "have", engine.GetPeriod())
+	}
+	for _, test := range []struct {
+		config *params.XDPoSConfig
+		what   string
+	}{
+		{&params.XDPoSConfig{Period: 10, Epoch: 60, Gap: 5}, "epoch change"},
+		{&params.XDPoSConfig{Period: 10, Epoch: 30, Gap: 10}, "gap change"},
+		{&params.XDPoSConfig{Period: 10, Epoch: 30, Gap: 5, RewardCheckpoint: 30}, "rewards change"},
+		{&params.XDPoSConfig{Period: 10, Epoch: 30, Gap: 5, CheckpointValidatorsBlock: big.NewInt(30)}, "fork change"},
+		{&params.XDPoSConfig{Period: 1, Epoch: 30, Gap: 5}, "period below the chain's"},
+		{&params.XDPoSConfig{Period: 10, Epoch: 30, Gap: 5, RecentSignerLimit: 1}, "limit below the chain's"},
+		{&params.XDPoSConfig{Period: 10, Epoch: 30, Gap: 5, RecentSignerLimit: 4}, "limit above the recent signers window"},
+	} {
+		if err := engine.ReloadConfig(chain, test.config); err == nil {
+			t.Error("reload should be rejected", "case", test.what)
+		}
+	}
+	if engine.sealingPeriod() != 10 || engine.sealSignerLimit != 2 {
+		t.Error("rejected reload shouldn't change the config", "period", engine.sealingPeriod(), "limit", engine.sealSignerLimit)
+	}
+	// Block 4 was sealed by the fourth signer, which the raised limit keeps from
+	// sealing block 6, while others may still accept it from the fourth signer
+	if err := engine.ReloadConfig(chain, &params.XDPoSConfig{Period: 10, Epoch: 30, Gap: 5, RecentSignerLimit: 2}); err != nil {
+		t.Fatal("can't reload config", "err", err)
+	}
+	wait, err := engine.authorizeSeal(chain, header, signers[3])
+	if err != nil || wait {
+		t.Error("fourth signer should seal block 6 with the chain's limit", "wait", wait, "err", err)
+	}
+	if err := engine.ReloadConfig(chain, &params.XDPoSConfig{Period: 10, Epoch: 30, Gap: 5, RecentSignerLimit: 3}); err != nil {
+		t.Fatal("can't reload config", "err", err)
+	}
+	if wait, err := engine.authorizeSeal(chain, header, signers[3]); err != nil || !wait {
+		t.Error("reloaded recent signer limit not applied when sealing", "wait", wait, "err", err)
+	}
+	snap, err := engine.GetSnapshot(chain, head)
+	if err != nil {
+		t.Fatal("can't get snapshot", "err", err)
+	}
+	if engine.signedRecently(snap, engine.GetMasternodes(chain, head), signers[3], 6, engine.config.RecentSignerLimit) {
+		t.Error("reloaded recent signer limit applied to verification")
+	}
+}
+
+func TestVerifySigningTransactions(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 10, Gap: 5, RewardCheckpoint: 10}
+	keys, _ := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 8)
+
+	// Block 9 carries a successful and a failed signing transaction
+	signed, failed := newTestSigningTx(0), newTestSigningTx(1)
+	txs := types.Transactions{signed, failed}
+	receipts := types.Receipts{
+		{TxHash: signed.Hash(), Status: types.ReceiptStatusSuccessful},
+		{TxHash: failed.Hash(), Status: types.ReceiptStatusFailed},
+	}
+	parent := chain.CurrentHeader()
+	header := &types.Header{
+		ParentHash: parent.Hash(),
+		Number:     big.NewInt(9),
+		Difficulty: big.NewInt(3),
+		Time:       new(big.Int).Add(parent.Time, big.NewInt(2)),
+		TxHash:     types.DeriveSha(txs),
+		UncleHash:  uncleHash,
+		Extra:      make([]byte, extraVanity+extraSeal),
+	}
+	sealTestHeader(t, header, keys[8%len(keys)])
+	block := types.NewBlockWithHeader(header).WithBody(txs, nil)
+	chain.headers = append(chain.headers, block.Header())
+	checkpoint := &types.Header{ParentHash: block.Hash(), Number: big.NewInt(10)}
+
+	reader := &testBlockChainReader{testChainReader: *chain, block: block}
+	getReceipts := func(hash common.Hash) types.Receipts {
+		if hash == block.Hash() {
+			return receipts
+		}
+		return nil
+	}
+	engine := New(config, nil)
+
+	// Whether the failed transaction is left out of the cache or not depends on
+	// the receipts being available, both are accepted
+	engine.CacheData(block.Header(), txs, receipts)
+	if err := engine.VerifySigningTransactions(reader, checkpoint, getReceipts); err != nil {
+		t.Error("signing transactions cached with receipts should be accepted", "err", err)
+	}
+	engine.CacheSigner(block.Hash(), txs)
+	if err := engine.VerifySigningTransactions(reader, checkpoint, getReceipts); err != nil {
+		t.Error("signing transactions cached without receipts should be accepted", "err", err)
+	}
+	if err := engine.VerifySigningTransactions(reader, chain.headers[9], getReceipts); err != nil {
+		t.Error("non checkpoint blocks should not be checked", "err", err)
+	}
+	// A successful signing transaction left out of the rewards
+	engine.BlockSigners.Add(block.Hash(), []*types.Transaction{failed})
+	if err := engine.VerifySigningTransactions(reader, checkpoint, getReceipts); err != ErrMissingSigningTx {
+		t.Error("missing signing transaction should be rejected", "want", ErrMissingSigningTx, "have", err)
+	}
+	// Receipts which don't match the block can't tell which ones succeeded
+	if err := engine.VerifySigningTransactions(reader, checkpoint, func(common.Hash) types.Receipts { return nil }); err == nil {
+		t.Error("missing receipts should be reported")
+	}
+}
+
+func TestActualNextProducer(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 4)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	// Block 4 was sealed by the first signer, the second one is in-turn next
+	parent := chain.CurrentHeader()
+	producer, err := engine.ActualNextProducer(chain, parent)
+	if err != nil {
+		t.Fatal("can't get next producer", "err", err)
+	}
+	if producer != signers[1] {
+		t.Error("wrong next producer", "want", signers[1], "have", producer)
+	}
+	// Mark the in-turn signer as having sealed the parent, it must be skipped
+	snap, err := engine.GetSnapshot(chain, parent)
+	if err != nil {
+		t.Fatal("can't get snapshot", "err", err)
+	}
+	snap = snap.copy()
+	snap.Recents[parent.Number.Uint64()] = signers[1]
+	engine.recents.Add(snap.Hash, snap)
+
+	producer, err = engine.ActualNextProducer(chain, parent)
+	if err != nil {
+		t.Fatal("can't get next producer", "err", err)
+	}
+	if producer != signers[2] {
+		t.Error("recent signer should be skipped", "want", signers[2], "have", producer)
+	}
+}
+
+func TestMasternodeSetHash(t *testing.T) {
+	config := &params.XDPoSConfig{Epoch: 10}
+	chain := &testChainReader{config: &params.ChainConfig{ChainId: big.NewInt(1), XDPoS: config}}
+	masternodes := []common.Address{
+		common.StringToAddress("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"),
+		common.StringToAddress("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"),
+		common.StringToAddress("cccccccccccccccccccccccccccccccccccccccc"),
+	}
+	epochs := [][]common.Address{
+		{masternodes[0], masternodes[1], masternodes[2]},
+		{masternodes[2], masternodes[0], masternodes[1]},
+		{masternodes[2], masternodes[0]},
+	}
+	for i := 0; i <= 20; i++ {
+		header := &types.Header{Number: big.NewInt(int64(i)), Extra: make([]byte, extraVanity+extraSeal)}
+		if i%10 == 0 {
+			extra := append(make([]byte, extraVanity), common.ExtractAddressToBytes(epochs[i/10])...)
+			header.Extra = append(extra, make([]byte, extraSeal)...)
+		}
+		chain.headers = append(chain.headers, header)
+	}
+	engine := New(config, nil)
+	hashes := make([]common.Hash, len(epochs))
+	for i := range epochs {
+		hash, err := engine.MasternodeSetHash(chain, uint64(i))
+		if err != nil {
+			t.Fatal("can't hash masternode set", "epoch", i, "err", err)
+		}
+		hashes[i] = hash
+	}
+	if hashes[0] != hashes[1] {
+		t.Error("same masternode sets should have the same hash", "epoch0", hashes[0], "epoch1", hashes[1])
+	}
+	if hashes[0] == hashes[2] {
+		t.Error("different masternode sets should have different hashes")
+	}
+	if _, err := engine.MasternodeSetHash(chain, 3); err != errUnknownBlock {
+		t.Error("unknown epoch should be rejected", "want", errUnknownBlock, "have", err)
+	}
+}
+
+func TestVerifyCheckpointValidators(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 29)
+
+	// Before the fork, checkpoints produced without validators remain valid
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	engine.Authorize(signers[29%len(signers)], nil)
+	checkpoint := &types.Header{ParentHash: chain.CurrentHeader().Hash(), Number: big.NewInt(30), UncleHash: uncleHash}
+	if err := engine.Prepare(chain, checkpoint); err != nil {
+		t.Fatal("can't prepare checkpoint", "err", err)
+	}
+	if len(checkpoint.Validators) != 0 {
+		t.Fatal("checkpoint prepared without validator hook carries validators")
+	}
+	sealTestHeader(t, checkpoint, keys[29%len(keys)])
+	if err := engine.verifyHeader(chain, checkpoint, nil, false); err != nil {
+		t.Error("checkpoint without validators should be valid before the fork", "err", err)
+	}
+	// Scheduling the fork past the checkpoint doesn't change that
+	config.CheckpointValidatorsBlock = big.NewInt(31)
+	if err := engine.verifyHeader(chain, checkpoint, nil, false); err != nil {
+		t.Error("checkpoint without validators should be valid right before the fork", "err", err)
+	}
+	// Once forked, every masternode needs a validator
+	config.CheckpointValidatorsBlock = big.NewInt(30)
+	if err := engine.verifyHeader(chain, checkpoint, nil, false); err != ErrMissingValidators {
+		t.Error("checkpoint without validators should be rejected", "want", ErrMissingValidators, "have", err)
+	}
+	checkpoint.Validators = bytes.Repeat([]byte{'0', '0', '0', '1'}, len(signers)-1)
+	sealTestHeader(t, checkpoint, keys[29%len(keys)])
+	if err := engine.verifyHeader(chain, checkpoint, nil, false); err != ErrMissingValidators {
+		t.Error("checkpoint with too few validators should be rejected", "want", ErrMissingValidators, "have", err)
+	}
+	checkpoint.Validators = bytes.Repeat([]byte{'0', '0', '0', '1'}, len(signers)+1)
+	sealTestHeader(t, checkpoint, keys[29%len(keys)])
+	if err := engine.verifyHeader(chain, checkpoint, nil, false); err != ErrMissingValidators {
+		t.Error("checkpoint with too many validators should be rejected", "want", ErrMissingValidators, "have", err)
+	}
+	checkpoint.Validators = bytes.Repeat([]byte{'0', '0', '0', '1'}, len(signers))
+	sealTestHeader(t, checkpoint, keys[29%len(keys)])
+	if err := engine.verifyHeader(chain, checkpoint, nil, false); err != nil {
+		t.Error("checkpoint with validators should be valid", "err", err)
+	}
+	// Checkpoints carrying validators ahead of the fork remain valid
+	config.CheckpointValidatorsBlock = nil
+	if err := engine.verifyHeader(chain, checkpoint, nil, false); err != nil {
+		t.Error("checkpoint with validators should be valid before the fork", "err", err)
+	}
+}
+
+func TestShuffleMasternodes(t *testing.T) {
+	masternodes := make([]common.Address, 10)
+	for i := range masternodes {
+		masternodes[i] = common.BigToAddress(big.NewInt(int64(i + 1)))
+	}
+	seed := common.HexToHash("0x0102030405")
+	shuffled := shuffleMasternodes(masternodes, seed)
+	if !reflect.DeepEqual(shuffled, shuffleMasternodes(masternodes, seed)) {
+		t.Error("shuffle should be deterministic given the seed")
+	}
+	if reflect.DeepEqual(shuffled, masternodes) {
+		t.Error("shuffle should change the order")
+	}
+	if !compareSignersLists(append([]common.Address{}, shuffled...), append([]common.Address{}, masternodes...)) {
+		t.Error("shuffle should keep the same masternodes", "have", shuffled)
+	}
+	if reflect.DeepEqual(shuffled, shuffleMasternodes(masternodes, common.HexToHash("0x0504030201"))) {
+		t.Error("different seeds should give different orders")
+	}
+
+}
+
+func TestShuffleMasternodesFork(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 10, Gap: 5, ShuffleMasternodesBlock: big.NewInt(20)}
+	keys, signers := newTestSigners(t, 5)
+	chain := newTestChain(t, config, keys, 9)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	prepare := func(number int) *types.Header {
+		engine.Authorize(signers[(number-1)%len(signers)], nil)
+		header := &types.Header{ParentHash: chain.CurrentHeader().Hash(), Number: big.NewInt(int64(number)), UncleHash: uncleHash}
+		if err := engine.Prepare(chain, header); err != nil {
+			t.Fatal("can't prepare header", "number", number, "err", err)
+		}
+		sealTestHeader(t, header, keys[(number-1)%len(keys)])
+		return header
+	}
+	// setOrder rewrites the masternodes listed by a checkpoint and reseals it
+	setOrder := func(checkpoint *types.Header, masternodes []common.Address) {
+		checkpoint.Extra = append(append(make([]byte, extraVanity), common.ExtractAddressToBytes(masternodes)...), make([]byte, extraSeal)...)
+		sealTestHeader(t, checkpoint, keys[(checkpoint.Number.Uint64()-1)%uint64(len(keys))])
+	}
+	// Before the fork, checkpoints list the masternodes sorted
+	checkpoint := prepare(10)
+	if have := engine.GetMasternodesFromCheckpointHeader(checkpoint, 10, 10); !reflect.DeepEqual(have, signers) {
+		t.Error("masternodes should not be shuffled before the fork", "want", signers, "have", have)
+	}
+	if err := engine.verifyHeader(chain, checkpoint, nil, false); err != nil {
+		t.Fatal("checkpoint before the fork should be valid", "err", err)
+	}
+	// but their order isn't enforced
+	reversed := make([]common.Address, len(signers))
+	for i, signer := range signers {
+		reversed[len(signers)-1-i] = signer
+	}
+	unsorted := types.CopyHeader(checkpoint)
+	setOrder(unsorted, reversed)
+	if err := engine.verifyHeader(chain, unsorted, nil, false); err != nil {
+		t.Error("checkpoint in another order should be valid before the fork", "err", err)
+	}
+	chain.headers = append(chain.headers, checkpoint)
+	for i := 11; i < 20; i++ {
+		header := prepare(i)
+		chain.headers = append(chain.headers, header)
+	}
+	// Past the fork, the checkpoint lists them shuffled with its parent hash, and
+	// the blocks of the epoch follow that order
+	checkpoint = prepare(20)
+	want := shuffleMasternodes(signers, checkpoint.ParentHash)
+	if have := engine.GetMasternodesFromCheckpointHeader(checkpoint, 20, 10); !reflect.DeepEqual(have, want) {
+		t.Error("wrong masternodes order after the fork", "want", want, "have", have)
+	}
+	if err := engine.verifyHeader(chain, checkpoint, nil, false); err != nil {
+		t.Error("shuffled checkpoint should be valid", "err", err)
+	}
+	chain.headers = append(chain.headers, checkpoint)
+	if have := engine.GetMasternodes(chain, prepare(21)); !reflect.DeepEqual(have, want) {
+		t.Error("blocks of the epoch should follow the checkpoint order", "want", want, "have", have)
+	}
+	// Any other order of the same masternodes is rejected past the fork,
+	// including the sorted one used before it
+	wrong := append([]common.Address{}, want...)
+	wrong[0], wrong[1] = wrong[1], wrong[0]
+	setOrder(checkpoint, wrong)
+	if err := engine.verifyHeader(chain, checkpoint, nil, false); err != errInvalidCheckpointSigners {
+		t.Error("checkpoint in another order should be rejected", "want", errInvalidCheckpointSigners, "have", err)
+	}
+	if !reflect.DeepEqual(want, signers) {
+		setOrder(checkpoint, signers)
+		if err := engine.verifyHeader(chain, checkpoint, nil, false); err != errInvalidCheckpointSigners {
+			t.Error("sorted checkpoint should be rejected after the fork", "want", errInvalidCheckpointSigners, "have", err)
+		}
+	}
+	// as well as a different set of masternodes in the shuffled order
+	setOrder(checkpoint, want[1:])
+	if err := engine.verifyHeader(chain, checkpoint, nil, false); err != errInvalidCheckpointSigners {
+		t.Error("checkpoint missing a masternode should be rejected", "want", errInvalidCheckpointSigners, "have", err)
+	}
+}
+
+func TestValidateBlockSignersCache(t *testing.T) {
+	config := &params.XDPoSConfig{Epoch: 900}
+	engine := New(config, nil)
+
+	txs := []*types.Transaction{newTestSigningTx(0), newTestSigningTx(1)}
+	block := types.NewBlock(&types.Header{Number: big.NewInt(1)}, txs, nil, nil)
+	chain := &testBlockChainReader{
+		testChainReader: testChainReader{config: &params.ChainConfig{ChainId: big.NewInt(1), XDPoS: config}},
+		block:           block,
+	}
+	if err := engine.ValidateBlockSignersCache(chain, block.Hash()); err != nil {
+		t.Error("uncached block should be accepted", "err", err)
+	}
+	engine.CacheSigner(block.Hash(), txs)
+	if err := engine.ValidateBlockSignersCache(chain, block.Hash()); err != nil {
+		t.Error("consistent cache should be accepted", "err", err)
+	}
+	engine.BlockSigners.Add(block.Hash(), []*types.Transaction{txs[0], newTestSigningTx(2)})
+	if err := engine.ValidateBlockSignersCache(chain, block.Hash()); err != errBlockSignersMismatch {
+		t.Error("corrupted cache should be rejected", "want", errBlockSignersMismatch, "have", err)
+	}
+}
+
+func TestLogMasternodes(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 29)
+
+	var records []*log.Record
+	defer log.Root().SetHandler(log.Root().GetHandler())
+	log.Root().SetHandler(log.FuncHandler(func(r *log.Record) error {
+		if r.Msg == "Masternodes of new epoch" {
+			records = append(records, r)
+		}
+		return nil
+	}))
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	prepare := func(number int64) {
+		parent := chain.GetHeaderByNumber(uint64(number - 1))
+		if err := engine.Prepare(chain, &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(number)}); err != nil {
+			t.Fatal("can't prepare header", "number", number, "err", err)
+		}
+	}
+	prepare(29)
+	prepare(30)
+	if len(records) != 0 {
+		t.Fatal("masternodes logged without being enabled", "records", len(records))
+	}
+	engine.LogMasternodes = true
+	prepare(29)
+	prepare(30)
+	if len(records) != 1 {
+		t.Fatal("masternodes should be logged once per epoch", "records", len(records))
+	}
+	ctx := records[0].Ctx
+	if len(ctx) != 6 || ctx[1] != uint64(30) || !reflect.DeepEqual(ctx[3], signers) || len(ctx[5].([]common.Address)) != 0 {
+		t.Error("wrong masternodes log", "ctx", ctx)
+	}
+}
+
+func TestAuthorBatch(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 6)
+
+	headers := []*types.Header{chain.headers[1], chain.headers[2]}
+	// A header without room for a seal, and one with a garbage seal
+	headers = append(headers, &types.Header{Number: big.NewInt(3), Extra: make([]byte, extraSeal-1)})
+	garbage := types.CopyHeader(chain.headers[3])
+	garbage.Extra[len(garbage.Extra)-1] = 0xff
+	headers = append(headers, garbage, chain.headers[4])
+
+	engine := New(config, nil)
+	authors, errs := engine.AuthorBatch(headers)
+	if len(authors) != len(headers) || len(errs) != len(headers) {
+		t.Fatal("wrong number of results", "authors", len(authors), "errs", len(errs))
+	}
+	for i, want := range map[int]common.Address{0: signers[0], 1: signers[1], 4: signers[0]} {
+		if errs[i] != nil || authors[i] != want {
+			t.Error("wrong author", "index", i, "want", want, "have", authors[i], "err", errs[i])
+		}
+	}
+	if errs[2] != errMissingSignature {
+		t.Error("header without seal should fail", "want", errMissingSignature, "have", errs[2])
+	}
+	if errs[3] == nil {
+		t.Error("header with garbage seal should fail")
+	}
+	if author, _ := engine.Author(headers[1]); author != signers[1] {
+		t.Error("recovered signers should be cached", "want", signers[1], "have", author)
+	}
+}
+
+func TestVerifyDifficultyRange(t *testing.T) {
+	for _, test := range []struct {
+		difficulty *big.Int
+		count      int
+		err        error
+	}{
+		{big.NewInt(1), 3, nil},
+		{big.NewInt(3), 3, nil},
+		{big.NewInt(0), 3, errInvalidDifficulty},
+		{big.NewInt(-1), 3, errInvalidDifficulty},
+		{big.NewInt(4), 3, errInvalidDifficulty},
+		{big.NewInt(1), 0, errInvalidDifficulty},
+		{nil, 3, errInvalidDifficulty},
+	} {
+		if err := VerifyDifficultyRange(&types.Header{Difficulty: test.difficulty}, test.count); err != test.err {
+			t.Error("wrong difficulty range check", "difficulty", test.difficulty, "count", test.count, "want", test.err, "have", err)
+		}
+	}
+}
+
+func TestVerifyCheckpointPenaltiesOrder(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 29)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	engine.HookPenalty = func(chain consensus.ChainReader, number uint64) ([]common.Address, error) {
+		return []common.Address{signers[2], signers[1]}, nil
+	}
+	parent := chain.CurrentHeader()
+	newCheckpoint := func(penalties []common.Address) *types.Header {
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     big.NewInt(30),
+			Difficulty: big.NewInt(3),
+			Time:       new(big.Int).Add(parent.Time, big.NewInt(2)),
+			UncleHash:  uncleHash,
+			Extra:      append(append(make([]byte, extraVanity), signers[0].Bytes()...), make([]byte, extraSeal)...),
+			Validators: []byte{'0', '0', '0', '0'},
+			Penalties:  common.ExtractAddressToBytes(penalties),
+		}
+		sealTestHeader(t, header, keys[29%len(keys)])
+		return header
+	}
+	// Prepared checkpoints carry the penalties in ascending order
+	prepared := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(30)}
+	if err := engine.Prepare(chain, prepared); err != nil {
+		t.Fatal("can't prepare checkpoint", "err", err)
+	}
+	if want := common.ExtractAddressToBytes([]common.Address{signers[1], signers[2]}); !bytes.Equal(prepared.Penalties, want) {
+		t.Error("penalties should be encoded in ascending order", "want", want, "have", prepared.Penalties)
+	}
+	for _, penalties := range [][]common.Address{{signers[1], signers[2]}, {signers[2], signers[1]}} {
+		if err := engine.verifyHeader(chain, newCheckpoint(penalties), nil, false); err == errInvalidCheckpointPenalties {
+			t.Error("same penalties in any order should be accepted", "penalties", penalties)
+		}
+	}
+	if err := engine.verifyHeader(chain, newCheckpoint([]common.Address{signers[1]}), nil, false); err != errInvalidCheckpointPenalties {
+		t.Error("different penalties should be rejected", "want", errInvalidCheckpointPenalties, "have", err)
+	}
+}
+
+func TestAmIPenalised(t *testing.T) {
+	config := &params.XDPoSConfig{Epoch: 10}
+	chain := &testChainReader{config: &params.ChainConfig{ChainId: big.NewInt(1), XDPoS: config}}
+
+	local := common.StringToAddress("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	other := common.StringToAddress("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	penalties := map[int][]common.Address{20: {other, local}, 40: {other}}
+	for i := 0; i <= 85; i++ {
+		header := &types.Header{Number: big.NewInt(int64(i)), Extra: make([]byte, extraVanity+extraSeal)}
+		header.Penalties = common.ExtractAddressToBytes(penalties[i])
+		chain.headers = append(chain.headers, header)
+	}
+	engine := New(config, nil)
+	engine.Authorize(local, nil)
+	for _, test := range []struct {
+		head      int
+		penalised bool
+		until     uint64
+	}{
+		{15, false, 0},
+		{20, true, 6},
+		{45, true, 6},
+		{69, true, 6},
+		{70, false, 0},
+		{85, false, 0},
+	} {
+		penalised, until, err := engine.AmIPenalised(chain, chain.headers[test.head])
+		if err != nil {
+			t.Fatal("can't check penalties", "err", err)
+		}
+		if penalised != test.penalised || until != test.until {
+			t.Error("wrong penalty status", "head", test.head, "want", test.penalised, test.until, "have", penalised, until)
+		}
+	}
+}
+
+func TestStrictBlockTime(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, _ := newTestSigners(t, 3)
+	// The test chain was produced long ago, simulating a downtime since then
+	chain := newTestChain(t, config, keys, 4)
+	parent := chain.CurrentHeader()
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	header := &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(5)}
+	if err := engine.Prepare(chain, header); err != nil {
+		t.Fatal("can't prepare header", "err", err)
+	}
+	if header.Time.Int64() < time.Now().Unix()-1 {
+		t.Error("header should catch up with the current time", "time", header.Time)
+	}
+	engine.StrictBlockTime = true
+	if err := engine.Prepare(chain, &types.Header{ParentHash: parent.Hash(), Number: big.NewInt(5)}); err != errSlotPassed {
+		t.Error("passed slot should be refused", "want", errSlotPassed, "have", err)
+	}
+}
+
+func TestVerifyGenesisConsistency(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5, RewardCheckpoint: 30}
+	keys, _ := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 0)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	if err := engine.VerifyGenesisConsistency(chain); err != nil {
+		t.Error("consistent genesis should be accepted", "err", err)
+	}
+	// An engine running with another epoch than the chain is inconsistent
+	if err := New(&params.XDPoSConfig{Period: 2, Epoch: 60, Gap: 5}, db).VerifyGenesisConsistency(chain); err == nil {
+		t.Error("mismatching epoch should be refused")
+	}
+	// So is a genesis without masternodes
+	genesis := types.CopyHeader(chain.headers[0])
+	genesis.Extra = make([]byte, extraVanity+extraSeal)
+	chain.headers[0] = genesis
+	if err := engine.VerifyGenesisConsistency(chain); err != ErrEmptyCheckpointSigners {
+		t.Error("genesis without masternodes should be refused", "want", ErrEmptyCheckpointSigners, "have", err)
+	}
+	// Or with a truncated masternode list
+	genesis.Extra = make([]byte, extraVanity+common.AddressLength-1+extraSeal)
+	if err := engine.VerifyGenesisConsistency(chain); err != errInvalidCheckpointSigners {
+		t.Error("truncated masternode list should be refused", "want", errInvalidCheckpointSigners, "have", err)
+	}
+}
+
+func TestOutOfTurnBlocks(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, _ := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 3)
+
+	// Block 4 is in-turn for the first signer, but sealed by the second one
+	for i, key := range []*ecdsa.PrivateKey{keys[1], keys[2], keys[0]} {
+		parent := chain.CurrentHeader()
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     big.NewInt(int64(4 + i)),
+			Difficulty: big.NewInt(1),
+			Time:       new(big.Int).Add(parent.Time, new(big.Int).SetUint64(config.Period)),
+			UncleHash:  uncleHash,
+			Extra:      make([]byte, extraVanity+extraSeal),
+		}
+		sealTestHeader(t, header, key)
+		chain.headers = append(chain.headers, header)
+	}
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	blocks, err := engine.OutOfTurnBlocks(chain, 0)
+	if err != nil {
+		t.Fatal("can't get out of turn blocks", "err", err)
+	}
+	if !reflect.DeepEqual(blocks, []uint64{4}) {
+		t.Error("wrong out of turn blocks", "want", []uint64{4}, "have", blocks)
+	}
+	if _, err := engine.OutOfTurnBlocks(chain, 1); err != errUnknownBlock {
+		t.Error("future epoch should be refused", "want", errUnknownBlock, "have", err)
+	}
+}
+
+func TestVerifyCheckpointVote(t *testing.T) {
+	config := &params.XDPoSConfig{Epoch: 900}
+	chain := &testChainReader{config: &params.ChainConfig{ChainId: big.NewInt(1), XDPoS: config}}
+	engine := New(config, nil)
+
+	var authNonce types.BlockNonce
+	copy(authNonce[:], nonceAuthVote)
+	invalidNonce := types.EncodeNonce(1)
+	candidate := common.HexToAddress("0x01")
+	tests := []struct {
+		coinbase common.Address
+		nonce    types.BlockNonce
+		err      error
+	}{
+		{common.Address{}, types.BlockNonce{}, nil},                // No vote
+		{candidate, authNonce, ErrCheckpointVoteConflict},          // Authorization vote
+		{candidate, types.BlockNonce{}, ErrCheckpointVoteConflict}, // Deauthorization vote
+		{candidate, invalidNonce, errInvalidCheckpointBeneficiary}, // Beneficiary without a vote nonce
+		{common.Address{}, authNonce, errInvalidCheckpointVote},    // Authorization nonce without a beneficiary
+		{common.Address{}, invalidNonce, errInvalidVote},           // Invalid nonce without a beneficiary
+	}
+	for i, tt := range tests {
+		header := &types.Header{
+			Number:     big.NewInt(900),
+			Coinbase:   tt.coinbase,
+			Nonce:      tt.nonce,
+			Difficulty: big.NewInt(2),
+			Time:       big.NewInt(1544771829),
+			UncleHash:  uncleHash,
+			Extra:      make([]byte, extraVanity+common.AddressLength+extraSeal),
+		}
+		err := engine.verifyHeader(chain, header, nil, false)
+		switch {
+		case tt.err != nil && err != tt.err:
+			t.Error("wrong checkpoint vote error", "test", i, "want", tt.err, "have", err)
+		case tt.err == nil && (err == ErrCheckpointVoteConflict || err == errInvalidCheckpointBeneficiary || err == errInvalidCheckpointVote):
+			t.Error("valid checkpoint vote encoding rejected", "test", i, "err", err)
+		}
+	}
+}
+
+func TestVerifyRotationSegment(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, _ := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 6)
+
+	db, _ := ethdb.NewMemDatabase()
+	if err := New(config, db).VerifyRotationSegment(chain, 0, 6); err != nil {
+		t.Error("valid segment should be accepted", "err", err)
+	}
+	// Claim an out-of-turn difficulty for the in-turn block 5, and link block 6
+	// to the tampered block
+	header := types.CopyHeader(chain.headers[5])
+	header.Difficulty = big.NewInt(1)
+	sealTestHeader(t, header, keys[1])
+	chain.headers[5] = header
+	header = types.CopyHeader(chain.headers[6])
+	header.ParentHash = chain.headers[5].Hash()
+	sealTestHeader(t, header, keys[2])
+	chain.headers[6] = header
+
+	db, _ = ethdb.NewMemDatabase()
+	err := New(config, db).VerifyRotationSegment(chain, 0, 6)
+	if want := fmt.Sprintf("block 5: %v", errInvalidDifficulty); err == nil || err.Error() != want {
+		t.Error("wrong difficulty should be reported", "want", want, "have", err)
+	}
+}
+
+func TestSyncFutureBlockTolerance(t *testing.T) {
+	config := &params.XDPoSConfig{Epoch: 900}
+	chain := &testChainReader{config: &params.ChainConfig{ChainId: big.NewInt(1), XDPoS: config}}
+	header := &types.Header{
+		Number:     big.NewInt(1),
+		Difficulty: big.NewInt(1),
+		Time:       big.NewInt(time.Now().Add(30 * time.Second).Unix()),
+		UncleHash:  uncleHash,
+		Extra:      make([]byte, extraVanity+extraSeal),
+		Validator:  make([]byte, extraSeal),
+	}
+	syncing := false
+	engine := New(config, nil)
+	engine.HookSyncing = func() bool { return syncing }
+	engine.SyncFutureBlockTolerance = time.Minute
+
+	if err := engine.verifyHeader(chain, header, nil, true); err != consensus.ErrFutureBlock {
+		t.Error("near future header should be rejected live", "want", consensus.ErrFutureBlock, "have", err)
+	}
+	syncing = true
+	if err := engine.verifyHeader(chain, header, nil, true); err == consensus.ErrFutureBlock {
+		t.Error("near future header should be accepted while syncing")
+	}
+	header.Time = big.NewInt(time.Now().Add(2 * time.Minute).Unix())
+	if err := engine.verifyHeader(chain, header, nil, true); err != consensus.ErrFutureBlock {
+		t.Error("far future header should be rejected while syncing", "want", consensus.ErrFutureBlock, "have", err)
+	}
+}
+
+func TestCanSign(t *testing.T) {
+	keys, signers := newTestSigners(t, 2)
+	engine := New(&params.XDPoSConfig{Epoch: 900}, nil)
+	if err := engine.CanSign(); err != errNoSigner {
+		t.Error("missing signer should be reported", "want", errNoSigner, "have", err)
+	}
+	engine.Authorize(signers[0], nil)
+	if err := engine.CanSign(); err != errNoSignFn {
+		t.Error("missing sign function should be reported", "want", errNoSignFn, "have", err)
+	}
+	signWith := func(key *ecdsa.PrivateKey) func(accounts.Account, []byte) ([]byte, error) {
+		return func(account accounts.Account, hash []byte) ([]byte, error) {
+			return crypto.Sign(hash, key)
+		}
+	}
+	engine.Authorize(signers[0], signWith(keys[1]))
+	if err := engine.CanSign(); err == nil {
+		t.Error("sign function of another account should be reported")
+	}
+	engine.Authorize(signers[0], signWith(keys[0]))
+	if err := engine.CanSign(); err != nil {
+		t.Error("valid signer should be usable", "err", err)
+	}
+}
+
+func TestPenaltyExpiry(t *testing.T) {
+	config := &params.XDPoSConfig{Epoch: 10}
+	chain := &testChainReader{config: &params.ChainConfig{ChainId: big.NewInt(1), XDPoS: config}}
+	penalised, other := common.HexToAddress("0x01"), common.HexToAddress("0x02")
+	for i := 0; i <= 80; i++ {
+		header := &types.Header{Number: big.NewInt(int64(i))}
+		if i == 10 {
+			header.Penalties = penalised.Bytes()
+		}
+		chain.headers = append(chain.headers, header)
+	}
+	engine := New(config, nil)
+
+	// The penalty of checkpoint 10 applies until checkpoint 10+LimitPenaltyEpoch*10
+	last := uint64(10 + common.LimitPenaltyEpoch*10)
+	for number := uint64(20); number <= last+20; number += 10 {
+		masternodes := []common.Address{penalised, other}
+		excluded := position(engine.removeRecentPenalties(chain, masternodes, number), penalised) < 0
+		if want := number <= last; excluded != want {
+			t.Error("wrong penalty exclusion", "number", number, "want", want, "have", excluded)
+		}
+		reinstated, err := engine.IsReinstatedAt(chain, chain.headers[number], penalised)
+		if err != nil {
+			t.Fatal("can't check reinstatement", "number", number, "err", err)
+		}
+		if want := number == last+10; reinstated != want {
+			t.Error("wrong reinstatement", "number", number, "want", want, "have", reinstated)
+		}
+	}
+	if reinstated, _ := engine.IsReinstatedAt(chain, chain.headers[last+10], other); reinstated {
+		t.Error("never penalised address can't be reinstated")
+	}
+	if _, err := engine.IsReinstatedAt(chain, chain.headers[15], penalised); err == nil {
+		t.Error("non checkpoint block should be refused")
+	}
+}
+
+func TestCustomSigningTxPredicate(t *testing.T) {
+	signingContract := common.HexToAddress("0x00000000000000000000000000000000000000aa")
+	signTx := types.NewTransaction(0, signingContract, big.NewInt(0), 200000, big.NewInt(0), nil)
+	txs := []*types.Transaction{newTestSigningTx(1), signTx}
+	receipts := []*types.Receipt{
+		{TxHash: txs[0].Hash(), Status: types.ReceiptStatusSuccessful},
+		{TxHash: txs[1].Hash(), Status: types.ReceiptStatusSuccessful},
+	}
+
+	engine := New(&params.XDPoSConfig{Epoch: 900}, nil)
+	header := &types.Header{Number: big.NewInt(1)}
+	if cached := engine.CacheData(header, txs, receipts); len(cached) != 1 || cached[0] != txs[0] {
+		t.Error("default predicate should recognize the standard signing contract", "cached", cached)
+	}
+	engine.IsSigningTx = func(tx *types.Transaction) bool {
+		return tx.To() != nil && *tx.To() == signingContract
+	}
+	if cached := engine.CacheData(header, txs, receipts); len(cached) != 1 || cached[0] != signTx {
+		t.Error("custom predicate should recognize the custom signing contract", "cached", cached)
+	}
+	if cached, _ := engine.BlockSigners.Get(header.Hash()); len(cached.([]*types.Transaction)) != 1 || cached.([]*types.Transaction)[0] != signTx {
+		t.Error("wrong cached signing transactions", "cached", cached)
+	}
+}
+
+func TestVerifyStaleParentSnapshot(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, _ := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 5)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	header, parent := chain.headers[5], chain.headers[4]
+
+	// Cache the snapshot of the grandparent in place of the parent's one
+	snap, err := engine.GetSnapshot(chain, chain.headers[3])
+	if err != nil {
+		t.Fatal("can't get snapshot", "err", err)
+	}
+	engine.recents.Add(parent.Hash(), snap)
+
+	if err := engine.verifyHeader(chain, header, nil, false); err != nil {
+		t.Fatal("header should verify despite the stale snapshot", "err", err)
+	}
+	cached, ok := engine.recents.Peek(parent.Hash())
+	if !ok || cached.(*Snapshot).Hash != parent.Hash() || cached.(*Snapshot).Number != 4 {
+		t.Error("stale snapshot should be replaced", "cached", cached)
+	}
+}
+
+func TestValidateCheckpointExtra(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 10, Gap: 3}
+	keys, _ := newTestSigners(t, 3)
+	engine := New(config, nil)
+
+	extra := make([]byte, extraVanity)
+	for _, key := range keys {
+		extra = append(extra, crypto.PubkeyToAddress(key.PublicKey).Bytes()...)
+	}
+	header := &types.Header{
+		Number:     big.NewInt(10),
+		Difficulty: big.NewInt(3),
+		Time:       big.NewInt(1544771829),
+		Extra:      append(extra, make([]byte, extraSeal)...),
+		Validators: make([]byte, 3*M2ByteLength),
+	}
+	sealTestHeader(t, header, keys[0])
+
+	report, err := engine.ValidateCheckpointExtra(header)
+	if err != nil {
+		t.Fatal("well-formed checkpoint should be valid", "err", err)
+	}
+	want := CheckpointExtraReport{VanityBytes: extraVanity, MasternodeCount: 3, SealPresent: true, ValidatorsCount: 3}
+	if *report != want {
+		t.Error("wrong checkpoint report", "want", want, "have", *report)
+	}
+	// Drop a byte from the masternode list
+	header.Extra = append(append([]byte{}, extra[:len(extra)-1]...), make([]byte, extraSeal)...)
+	report, err = engine.ValidateCheckpointExtra(header)
+	if err != errInvalidCheckpointSigners {
+		t.Error("misaligned checkpoint should be invalid", "want", errInvalidCheckpointSigners, "have", err)
+	}
+	if report.VanityBytes != extraVanity || report.MasternodeCount != 2 || report.SealPresent {
+		t.Error("wrong misaligned checkpoint report", "report", *report)
+	}
+}
+
+func TestSignerSetDiffAcrossReorg(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 10, Gap: 3}
+	keys, signers := newTestSigners(t, 4)
+	chain := newTestChain(t, config, keys[:3], 5)
+
+	// Extend the canonical chain and a side chain forking at block 5 past the
+	// next checkpoint, listing different masternodes
+	extend := func(parent *types.Header, masternodes []common.Address, time int64) []*types.Header {
+		var headers []*types.Header
+		for n := parent.Number.Int64() + 1; n <= 12; n++ {
+			extra := make([]byte, extraVanity)
+			if n%10 == 0 {
+				for _, masternode := range masternodes {
+					extra = append(extra, masternode[:]...)
+				}
+			}
+			header := &types.Header{
+				ParentHash: parent.Hash(),
+				Number:     big.NewInt(n),
+				Time:       big.NewInt(time + n),
+				Extra:      append(extra, make([]byte, extraSeal)...),
+			}
+			headers = append(headers, header)
+			parent = header
+		}
+		return headers
+	}
+	fork := chain.CurrentHeader()
+	chain.headers = append(chain.headers, extend(fork, signers[:3], 0)...)
+	chain.side = extend(fork, []common.Address{signers[0], signers[1], signers[3]}, 100)
+
+	engine := New(config, nil)
+	added, removed, err := engine.SignerSetDiffAcrossReorg(chain, chain.CurrentHeader(), chain.side[len(chain.side)-1])
+	if err != nil {
+		t.Fatal("can't diff signer sets", "err", err)
+	}
+	if !reflect.DeepEqual(added, signers[3:]) || !reflect.DeepEqual(removed, signers[2:3]) {
+		t.Error("wrong signer set diff", "added", added, "removed", removed)
+	}
+	// Heads within the same epoch before the fork don't change anything
+	added, removed, err = engine.SignerSetDiffAcrossReorg(chain, chain.headers[5], chain.headers[3])
+	if err != nil || len(added) != 0 || len(removed) != 0 {
+		t.Error("no change expected", "added", added, "removed", removed, "err", err)
+	}
+}
+
+func TestVerifyExcessivePenalties(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 29)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	parent := chain.CurrentHeader()
+	newCheckpoint := func(penalties []common.Address) *types.Header {
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     big.NewInt(30),
+			Difficulty: big.NewInt(3),
+			Time:       new(big.Int).Add(parent.Time, big.NewInt(2)),
+			UncleHash:  uncleHash,
+			Extra:      append(append(make([]byte, extraVanity), signers[0].Bytes()...), make([]byte, extraSeal)...),
+			Validators: []byte{'0', '0', '0', '0'},
+			Penalties:  common.ExtractAddressToBytes(penalties),
+		}
+		sealTestHeader(t, header, keys[29%len(keys)])
+		return header
+	}
+	majority := newCheckpoint(signers[1:])
+	if err := engine.verifyHeader(chain, majority, nil, false); err == ErrExcessivePenalties {
+		t.Error("penalties should be unbounded by default")
+	}
+	engine.MaxPenaltyPercent = 34
+	if err := engine.verifyHeader(chain, majority, nil, false); err != ErrExcessivePenalties {
+		t.Error("penalties above a third should be rejected", "want", ErrExcessivePenalties, "have", err)
+	}
+	if err := engine.verifyHeader(chain, newCheckpoint(signers[2:]), nil, false); err == ErrExcessivePenalties {
+		t.Error("penalties within a third should be accepted")
+	}
+}
+
+func TestDiagnoseDifficulty(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, _ := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 5)
+
+	var records []*log.Record
+	defer log.Root().SetHandler(log.Root().GetHandler())
+	log.Root().SetHandler(log.FuncHandler(func(r *log.Record) error {
+		if r.Msg == "Block difficulty mismatch" {
+			records = append(records, r)
+		}
+		return nil
+	}))
+	// Block 5 is in-turn for the second signer, claim an out-of-turn difficulty
+	header := types.CopyHeader(chain.headers[5])
+	header.Difficulty = big.NewInt(1)
+	sealTestHeader(t, header, keys[1])
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	if err := engine.verifySeal(chain, header, nil, false); err != errInvalidDifficulty {
+		t.Fatal("wrong difficulty should be rejected", "want", errInvalidDifficulty, "have", err)
+	}
+	if len(records) != 0 {
+		t.Fatal("difficulty logged without being enabled", "records", len(records))
+	}
+	engine.DiagnoseDifficulty = true
+	if err := engine.verifySeal(chain, header, nil, false); err != errInvalidDifficulty {
+		t.Fatal("wrong difficulty should be rejected", "want", errInvalidDifficulty, "have", err)
+	}
+	if len(records) != 1 {
+		t.Fatal("difficulty mismatch should be logged", "records", len(records))
+	}
+	ctx := make(map[interface{}]interface{})
+	for i := 0; i+1 < len(records[0].Ctx); i += 2 {
+		ctx[records[0].Ctx[i]] = records[0].Ctx[i+1]
+	}
+	if ctx["masternodes"] != 3 || ctx["preIndex"] != 0 || ctx["curIndex"] != 1 || ctx["hop"] != 0 || ctx["want"].(*big.Int).Int64() != 3 {
+		t.Error("wrong difficulty breakdown", "ctx", records[0].Ctx)
+	}
+}
+
+func TestEmergencyMasternodes(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, nil, 0)
+	genesis := chain.CurrentHeader()
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	engine.Bootstrap = true
+	if _, _, _, _, err := engine.YourTurn(chain, genesis, signers[0]); err != errNoMasternodes {
+		t.Error("production should halt without masternodes", "want", errNoMasternodes, "have", err)
+	}
+	engine.EmergencyMasternodes = signers
+	count, preIndex, curIndex, ok, err := engine.YourTurn(chain, genesis, signers[0])
+	if err != nil {
+		t.Fatal("emergency masternodes should be used", "err", err)
+	}
+	if count != 3 || preIndex != -1 || curIndex != 0 || !ok {
+		t.Error("wrong turn among emergency masternodes", "count", count, "preIndex", preIndex, "curIndex", curIndex, "ok", ok)
+	}
+	// The emergency masternodes only drive the local production, anything
+	// deciding which blocks are valid must ignore them
+	if _, err := engine.ActualNextProducer(chain, genesis); err != errNoMasternodes {
+		t.Error("producer prediction should ignore emergency masternodes", "want", errNoMasternodes, "have", err)
+	}
+	engine.Authorize(signers[0], func(account accounts.Account, hash []byte) ([]byte, error) {
+		return crypto.Sign(hash, keys[0])
+	})
+	header := &types.Header{ParentHash: genesis.Hash(), Number: big.NewInt(1), UncleHash: uncleHash}
+	if err := engine.Prepare(chain, header); err != nil {
+		t.Fatal("can't prepare block", "err", err)
+	}
+	if _, err := engine.Seal(chain, types.NewBlockWithHeader(header), nil); err != errUnauthorized {
+		t.Error("emergency masternodes outside the snapshot can't seal", "want", errUnauthorized, "have", err)
+	}
+	// Nodes with different emergency masternodes must agree on block validity
+	sealTestHeader(t, header, keys[0])
+	plainDb, _ := ethdb.NewMemDatabase()
+	plain := New(config, plainDb)
+	plain.Bootstrap = true
+	want := plain.VerifyHeader(chain, header, true)
+	if want == nil {
+		t.Fatal("block sealed by a non-masternode should be invalid")
+	}
+	if err := engine.VerifyHeader(chain, header, true); err != want {
+		t.Error("emergency masternodes changed block validity", "want", want, "have", err)
+	}
+}
+
+func TestProducersInRange(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 5)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	producers, err := engine.ProducersInRange(chain, 0, 5)
+	if err != nil {
+		t.Fatal("can't get producers", "err", err)
+	}
+	want := map[uint64]common.Address{1: signers[0], 2: signers[1], 3: signers[2], 4: signers[0], 5: signers[1]}
+	if !reflect.DeepEqual(producers, want) {
+		t.Error("wrong producers", "want", want, "have", producers)
+	}
+	if _, err := engine.ProducersInRange(chain, 4, 6); err == nil {
+		t.Error("range beyond the head should be refused")
+	}
+	if _, err := engine.ProducersInRange(chain, 1, maxProducersRange+1); err != errRangeTooLarge {
+		t.Error("oversized range should be refused", "want", errRangeTooLarge, "have", err)
+	}
+}
+
+func TestVerifyEpochDoubleValidation(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 900, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 899)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+
+	extra := make([]byte, extraVanity)
+	for _, signer := range signers {
+		extra = append(extra, signer.Bytes()...)
+	}
+	parent := chain.CurrentHeader()
+	checkpoint := &types.Header{
+		ParentHash: parent.Hash(),
+		Number:     big.NewInt(900),
+		Difficulty: big.NewInt(3),
+		Time:       new(big.Int).Add(parent.Time, big.NewInt(2)),
+		UncleHash:  uncleHash,
+		Extra:      append(extra, make([]byte, extraSeal)...),
+		Validators: []byte("000100020000"),
+	}
+	sealTestHeader(t, checkpoint, keys[899%len(keys)])
+	chain.headers = append(chain.headers, checkpoint)
+
+	// Block 903 is validated by another masternode than the assigned one
+	for i := 901; i <= 904; i++ {
+		parent := chain.CurrentHeader()
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     big.NewInt(int64(i)),
+			Difficulty: big.NewInt(3),
+			Time:       new(big.Int).Add(parent.Time, big.NewInt(2)),
+			UncleHash:  uncleHash,
+			Extra:      make([]byte, extraVanity+extraSeal),
+		}
+		sealTestHeader(t, header, keys[(i-1)%len(keys)])
+		assigned, err := engine.GetValidator(signers[(i-1)%len(keys)], chain, header)
+		if err != nil {
+			t.Fatal("can't get assigned validator", "err", err)
+		}
+		validator := position(signers, assigned)
+		if i == 903 {
+			validator = (validator + 1) % len(keys)
+		}
+		if header.Validator, err = crypto.Sign(sigHash(header).Bytes(), keys[validator]); err != nil {
+			t.Fatal("can't sign validator", "err", err)
+		}
+		chain.headers = append(chain.headers, header)
+	}
+	blocks, err := engine.VerifyEpochDoubleValidation(chain, 1)
+	if err != nil {
+		t.Fatal("can't verify double validation", "err", err)
+	}
+	if !reflect.DeepEqual(blocks, []uint64{903}) {
+		t.Error("wrong failed double validations", "want", []uint64{903}, "have", blocks)
+	}
+	if blocks, err := engine.VerifyEpochDoubleValidation(chain, 0); err != nil || len(blocks) != 0 {
+		t.Error("first epoch isn't double validated", "blocks", blocks, "err", err)
+	}
+	if _, err := engine.VerifyEpochDoubleValidation(chain, 2); err != errUnknownBlock {
+		t.Error("future epoch should be refused", "want", errUnknownBlock, "have", err)
+	}
+}
+
+func TestPruneVerifiedHeaders(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, _ := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 6)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	for i := 1; i <= 6; i++ {
+		if err := engine.verifyHeaderWithCache(chain, chain.headers[i], nil, false); err != nil {
+			t.Fatal("can't verify header", "number", i, "err", err)
+		}
+	}
+	// A horizon at the genesis doesn't prune anything
+	engine.PruneVerifiedHeaders(0)
+	for i := 1; i <= 6; i++ {
+		if !engine.verifiedHeaders.Contains(chain.headers[i].Hash()) {
+			t.Error("verified header above the horizon should be kept", "number", i)
+		}
+	}
+	// Delete the headers below block 4 as a header pruning would, the header
+	// right below the horizon can't be verified anymore without its parent
+	pruned := chain.headers[3]
+	for i := 0; i < 4; i++ {
+		chain.headers[i] = nil
+	}
+	if err := engine.verifyHeaderWithCache(chain, pruned, nil, false); err != nil {
+		t.Error("cached header should be served until pruned", "err", err)
+	}
+	engine.PruneVerifiedHeaders(4)
+
+	if engine.verifiedHeaders.Contains(pruned.Hash()) {
+		t.Error("verified header below the horizon should be pruned")
+	}
+	if err := engine.verifyHeaderWithCache(chain, pruned, nil, false); err != consensus.ErrUnknownAncestor {
+		t.Error("pruned header shouldn't verify once its ancestors are gone", "want", consensus.ErrUnknownAncestor, "have", err)
+	}
+	for i := 4; i <= 6; i++ {
+		if !engine.verifiedHeaders.Contains(chain.headers[i].Hash()) {
+			t.Error("verified header above the horizon should be kept", "number", i)
+		}
+	}
+}
+
+func TestMaxBlocksPerMasternode(t *testing.T) {
+	for _, test := range []struct {
+		masternodes int
+		epoch       uint64
+		max         uint64
+	}{
+		{0, 900, 0},
+		{1, 900, 900},
+		{2, 900, 450},
+		{3, 901, 451},
+		{18, 900, 450},
+		{150, 900, 450},
+	} {
+		if max := MaxBlocksPerMasternode(test.masternodes, test.epoch); max != test.max {
+			t.Error("wrong bound", "masternodes", test.masternodes, "epoch", test.epoch, "want", test.max, "have", max)
+		}
+	}
+}
+
+func TestIsAuthorisedAddressStrict(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 3)
+	outsider := common.StringToAddress("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+
+	// Snapshot hit
+	for addr, want := range map[common.Address]bool{signers[1]: true, outsider: false} {
+		if ok, err := engine.IsAuthorisedAddressStrict(chain.CurrentHeader(), chain, addr); err != nil || ok != want {
+			t.Error("wrong membership from snapshot", "address", addr, "want", want, "have", ok, "err", err)
+		}
+	}
+	// Snapshot miss, read from contract
+	orphan := &types.Header{ParentHash: common.HexToHash("0x01"), Number: big.NewInt(5), Extra: make([]byte, extraVanity+extraSeal)}
+	engine.HookGetSignersFromContract = func(block common.Hash) ([]common.Address, error) {
+		if block != orphan.Hash() {
+			t.Error("wrong block read from contract", "want", orphan.Hash(), "have", block)
+		}
+		return []common.Address{outsider}, nil
+	}
+	for addr, want := range map[common.Address]bool{signers[1]: false, outsider: true} {
+		if ok, err := engine.IsAuthorisedAddressStrict(orphan, chain, addr); err != nil || ok != want {
+			t.Error("wrong membership from contract", "address", addr, "want", want, "have", ok, "err", err)
+		}
+	}
+	// Both failing
+	engine.HookGetSignersFromContract = func(block common.Hash) ([]common.Address, error) {
+		return nil, errors.New("contract unavailable")
+	}
+	if ok, err := engine.IsAuthorisedAddressStrict(orphan, chain, outsider); err == nil || ok {
+		t.Error("undetermined membership should be reported", "ok", ok, "err", err)
+	}
+}
+
+func TestVerifyGapAvailability(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, _ := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 30)
+	checkpoint := chain.CurrentHeader()
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	if err := engine.VerifyGapAvailability(chain, checkpoint); err != nil {
+		t.Error("complete gap should be available", "err", err)
+	}
+	if err := engine.VerifyGapAvailability(chain, chain.headers[0]); err != nil {
+		t.Error("genesis has no gap", "err", err)
+	}
+	if err := engine.VerifyGapAvailability(chain, chain.headers[29]); err == nil {
+		t.Error("non checkpoint block should be refused")
+	}
+	chain.headers[27] = nil
+	err := engine.VerifyGapAvailability(chain, checkpoint)
+	if err == nil || err.Error() != fmt.Sprintf("block 27: %v", ErrMissingGapHeader) {
+		t.Error("missing gap header should be reported", "want", ErrMissingGapHeader, "have", err)
+	}
+	// The contract isn't relied on without the gap
+	engine.HookGetSignersFromContract = func(block common.Hash) ([]common.Address, error) {
+		t.Error("contract read without the gap")
+		return nil, nil
+	}
+	if _, err := engine.IsAuthorisedAddressStrict(checkpoint, chain, common.Address{}); err == nil {
+		t.Error("membership shouldn't be determined without the gap")
+	}
+}
+
+func TestDryRunSeal(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 3)
+	parent := chain.CurrentHeader()
+	block := types.NewBlockWithHeader(&types.Header{
+		ParentHash: parent.Hash(),
+		Number:     big.NewInt(4),
+		Difficulty: big.NewInt(3),
+		Time:       new(big.Int).Add(parent.Time, big.NewInt(2)),
+		UncleHash:  uncleHash,
+		Extra:      make([]byte, extraVanity+extraSeal),
+	})
+	for _, test := range []struct {
+		signer common.Address
+		seal   bool
+		err    error
+	}{
+		{signers[0], true, nil},  // Authorized and in-turn
+		{signers[2], false, nil}, // Authorized but sealed block 3
+		{common.StringToAddress("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), false, errUnauthorized},
+	} {
+		db, _ := ethdb.NewMemDatabase()
+		engine := New(config, db)
+		engine.Authorize(test.signer, nil)
+		header, seal, err := engine.DryRunSeal(chain, block)
+		if seal != test.seal || err != test.err {
+			t.Error("wrong dry run", "signer", test.signer, "want", test.seal, test.err, "have", seal, err)
+		}
+		if err == nil && (header.Hash() != block.Header().Hash() || !bytes.Equal(header.Extra, make([]byte, extraVanity+extraSeal))) {
+			t.Error("dry run header shouldn't be signed", "signer", test.signer)
+		}
+	}
+}
+
+func TestVerifyBlockIntegrity(t *testing.T) {
+	newReceipts := func(addr common.Address) types.Receipts {
+		receipt := types.NewReceipt(nil, false, 21000)
+		receipt.Logs = []*types.Log{{Address: addr}}
+		receipt.Bloom = types.CreateBloom(types.Receipts{receipt})
+		return types.Receipts{receipt}
+	}
+	receipts := newReceipts(common.HexToAddress("0x01"))
+	txs := []*types.Transaction{newTestSigningTx(0)}
+	block := types.NewBlock(&types.Header{Number: big.NewInt(1)}, txs, nil, receipts)
+
+	engine := New(&params.XDPoSConfig{Epoch: 900}, nil)
+	if err := engine.VerifyBlockIntegrity(block, receipts); err != nil {
+		t.Error("consistent block should be accepted", "err", err)
+	}
+	err := engine.VerifyBlockIntegrity(block, newReceipts(common.HexToAddress("0x02")))
+	if err == nil || !strings.HasPrefix(err.Error(), "invalid bloom") {
+		t.Error("bloom not matching the receipts should be rejected", "err", err)
+	}
+	header := block.Header()
+	header.TxHash = common.Hash{}
+	if err := engine.VerifyBlockIntegrity(block.WithSeal(header), receipts); err == nil {
+		t.Error("transaction root not matching the body should be rejected")
+	}
+}
+
+func TestCheckpointHeaderFor(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 5, Gap: 2}
+	keys, _ := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 12)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	for number, checkpoint := range map[uint64]int{0: 0, 3: 0, 5: 5, 7: 5, 10: 10, 12: 10} {
+		header, err := engine.CheckpointHeaderFor(chain, number)
+		if err != nil || header != chain.headers[checkpoint] {
+			t.Error("wrong checkpoint header", "number", number, "want", checkpoint, "have", header, "err", err)
+		}
+	}
+	chain.headers = chain.headers[:9]
+	if _, err := engine.CheckpointHeaderFor(chain, 12); err == nil || !strings.HasSuffix(err.Error(), ErrMissingCheckpointHeader.Error()) {
+		t.Error("missing checkpoint should be reported", "want", ErrMissingCheckpointHeader, "have", err)
+	}
+}
+
+func TestGetValidatorFirstEpoch(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 29)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	for _, number := range []int{0, 1, 29} {
+		if _, err := engine.GetValidator(signers[0], chain, chain.headers[number]); err != ErrNoValidatorBeforeFirstEpoch {
+			t.Error("first epoch block should have no validator", "number", number, "want", ErrNoValidatorBeforeFirstEpoch, "have", err)
+		}
+	}
+}
+
+func TestExportConsensusConfig(t *testing.T) {
+	config := &params.XDPoSConfig{
+		Period:              2,
+		Epoch:               900,
+		Reward:              250,
+		RewardCheckpoint:    900,
+		Gap:                 450,
+		FoudationWalletAddr: common.HexToAddress("0x92a289fe95a85c53b8d0d113cbaef0c1ec98ac65"),
+		RecentSignerLimit:   2,
+	}
+	engine := New(config, nil)
+	engine.StrictBlockTime = true
+	engine.MaxPenaltyPercent = 30
+	engine.EmergencyMasternodes = []common.Address{common.HexToAddress("0x01")}
+	engine.FutureBlockTolerance = 2 * time.Second
+
+	blob, err := engine.ExportConsensusConfig()
+	if err != nil {
+		t.Fatal("can't export consensus config", "err", err)
+	}
+	var exported ConsensusConfig
+	if err := json.Unmarshal(blob, &exported); err != nil {
+		t.Fatal("can't decode consensus config", "err", err)
+	}
+	want := ConsensusConfig{
+		XDPoSConfig:          *config,
+		StrictBlockTime:      true,
+		MaxPenaltyPercent:    30,
+		EmergencyMasternodes: engine.EmergencyMasternodes,
+		FutureBlockTolerance: 2 * time.Second,
+		LimitPenaltyEpoch:    common.LimitPenaltyEpoch,
+		MergeSignRange:       common.MergeSignRange,
+	}
+	if !reflect.DeepEqual(exported, want) {
+		t.Error("consensus config doesn't round-trip", "want", want, "have", exported)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(blob, &fields); err != nil {
+		t.Fatal("can't decode consensus config fields", "err", err)
+	}
+	for _, field := range []string{"period", "epoch", "reward", "rewardCheckpoint", "gap", "foudationWalletAddr", "recentSignerLimit", "maxPenaltyPercent", "futureBlockTolerance", "limitPenaltyEpoch"} {
+		if _, ok := fields[field]; !ok {
+			t.Error("missing consensus config field", "field", field)
+		}
+	}
+}
+
+func TestVerifyEpochTiming(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 10, Gap: 5}
+	keys, _ := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 15)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	for epoch := uint64(0); epoch <= 1; epoch++ {
+		if err := engine.VerifyEpochTiming(chain, epoch, 0); err != nil {
+			t.Error("regular epoch should be accepted", "epoch", epoch, "err", err)
+		}
+	}
+	// Compress the timestamps of the blocks of the second epoch
+	for i := 10; i <= 15; i++ {
+		chain.headers[i].Time = new(big.Int).Add(chain.headers[10].Time, big.NewInt(int64(i-10)))
+	}
+	if err := engine.VerifyEpochTiming(chain, 1, 5*time.Second); err != nil {
+		t.Error("deviation within tolerance should be accepted", "err", err)
+	}
+	err := engine.VerifyEpochTiming(chain, 1, 5*time.Second-1)
+	if want := fmt.Sprintf("epoch 1 spans 5s, expected 10s: %v", ErrEpochTimingDeviation); err == nil || err.Error() != want {
+		t.Error("compressed epoch should be reported", "want", want, "have", err)
+	}
+	if err := engine.VerifyEpochTiming(chain, 2, time.Second); err != errUnknownBlock {
+		t.Error("future epoch should be refused", "want", errUnknownBlock, "have", err)
+	}
+}
+
+func TestOnMasternodeSetChange(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 3)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	var calls int
+	engine.OnMasternodeSetChange = func(old, new []common.Address) {
+		calls++
+		if !reflect.DeepEqual(old, signers) {
+			t.Error("wrong previous masternodes", "want", signers, "have", old)
+		}
+		if want := signers[1:]; !reflect.DeepEqual(new, want) {
+			t.Error("wrong new masternodes", "want", want, "have", new)
+		}
+	}
+	ms := []Masternode{{Address: signers[2], Stake: big.NewInt(2)}, {Address: signers[1], Stake: big.NewInt(1)}}
+	if err := engine.UpdateMasternodes(chain, chain.CurrentHeader(), ms); err != nil {
+		t.Fatal("can't update masternodes", "err", err)
+	}
+	if calls != 1 {
+		t.Error("hook should fire once per update", "calls", calls)
+	}
+}
+
+func TestDifficultyCache(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 3)
+	parent := chain.CurrentHeader()
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	want := engine.calcDifficulty(chain, parent, signers[1])
+
+	lookups := engine.EngineMetrics().RecentsCacheHits + engine.EngineMetrics().RecentsCacheMisses
+	if have := engine.calcDifficulty(chain, parent, signers[1]); have.Cmp(want) != 0 {
+		t.Error("wrong cached difficulty", "want", want, "have", have)
+	}
+	if metrics := engine.EngineMetrics(); metrics.RecentsCacheHits+metrics.RecentsCacheMisses != lookups {
+		t.Error("cached difficulty shouldn't look up the snapshot")
+	}
+	// A new masternode set on the parent invalidates its difficulties
+	ms := []Masternode{{Address: signers[0], Stake: big.NewInt(1)}, {Address: signers[1], Stake: big.NewInt(1)}}
+	if err := engine.UpdateMasternodes(chain, parent, ms); err != nil {
+		t.Fatal("can't update masternodes", "err", err)
+	}
+	if engine.difficulties.Contains(parent.Hash()) {
+		t.Error("difficulty should be invalidated with the snapshot")
+	}
+}
+
+func TestDifficultyCacheReorg(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 3)
+	parent := chain.CurrentHeader()
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	before := engine.calcDifficulty(chain, parent, signers[0])
+
+	// Reorg the checkpoint to one listing the masternodes in reverse order
+	checkpoint := types.CopyHeader(chain.headers[0])
+	for i, signer := range signers {
+		copy(checkpoint.Extra[extraVanity+(len(signers)-1-i)*common.AddressLength:], signer.Bytes())
+	}
+	chain.side = append(chain.side, chain.headers[0])
+	chain.headers[0] = checkpoint
+
+	after := engine.calcDifficulty(chain, parent, signers[0])
+	if after.Cmp(before) == 0 {
+		t.Fatal("difficulty cached for the reorged checkpoint", "difficulty", after)
+	}
+	engine.difficulties.Purge()
+	if want := engine.calcDifficulty(chain, parent, signers[0]); after.Cmp(want) != 0 {
+		t.Error("wrong difficulty after the checkpoint reorg", "want", want, "have", after)
+	}
+}
+
+// BenchmarkResyncDifficulties verifies the rotation of a chain twice, like the
+// headers and then the blocks of a resync, reporting the snapshot lookups.
+func BenchmarkResyncDifficulties(b *testing.B) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 900, Gap: 450}
+	keys, _ := newTestSigners(b, 3)
+	chain := newTestChain(b, config, keys, 200)
+
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cached=%v", cached), func(b *testing.B) {
+			var lookups uint64
+			for i := 0; i < b.N; i++ {
+				db, _ := ethdb.NewMemDatabase()
+				engine := New(config, db)
+				for pass := 0; pass < 2; pass++ {
+					if !cached {
+						engine.difficulties.Purge()
+					}
+					if err := engine.VerifyRotationSegment(chain, 1, 200); err != nil {
+						b.Fatal("can't verify rotation", "err", err)
+					}
+				}
+				metrics := engine.EngineMetrics()
+				lookups += metrics.RecentsCacheHits + metrics.RecentsCacheMisses
+			}
+			b.ReportMetric(float64(lookups)/float64(b.N), "lookups/op")
+		})
+	}
+}
+
+func TestVerifySetAgainstEvents(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 29)
+
+	extra := make([]byte, extraVanity)
+	for _, signer := range signers[:2] {
+		extra = append(extra, signer.Bytes()...)
+	}
+	parent := chain.CurrentHeader()
+	checkpoint := &types.Header{
+		ParentHash: parent.Hash(),
+		Number:     big.NewInt(30),
+		Difficulty: big.NewInt(3),
+		Time:       new(big.Int).Add(parent.Time, big.NewInt(2)),
+		UncleHash:  uncleHash,
+		Extra:      append(extra, make([]byte, extraSeal)...),
+	}
+	sealTestHeader(t, checkpoint, keys[29%len(keys)])
+	chain.headers = append(chain.headers, checkpoint)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+
+	// The third masternode leaves before the gap, and joins back within it
+	events := []GovernanceEvent{
+		{Block: 0, Masternode: signers[0], Add: true},
+		{Block: 0, Masternode: signers[1], Add: true},
+		{Block: 0, Masternode: signers[2], Add: true},
+		{Block: 10, Masternode: signers[2], Add: false},
+		{Block: 27, Masternode: signers[2], Add: true},
+	}
+	if err := engine.VerifySetAgainstEvents(chain, checkpoint, events); err != nil {
+		t.Error("matching events should be accepted", "err", err)
+	}
+	err := engine.VerifySetAgainstEvents(chain, checkpoint, events[:3])
+	if want := fmt.Sprintf("checkpoint 30: %v (missing %v, unexpected [])", ErrGovernanceSetMismatch, signers[2:]); err == nil || err.Error() != want {
+		t.Error("mismatching events should be reported", "want", want, "have", err)
+	}
+}
+
+func TestRecentSignerLimit(t *testing.T) {
+	keys, signers := newTestSigners(t, 2)
+	for _, test := range []struct {
+		limit uint64
+		seal  bool
+	}{
+		{0, false}, // Default limit of 2, the last signer has to wait
+		{1, true},  // Limit of 1, the last signer may seal again
+		{5, false}, // Limit above the recent signers window, capped to 2
+	} {
+		config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5, RecentSignerLimit: test.limit}
+		chain := newTestChain(t, config, keys[:1], 1)
+		chain.headers[0].Extra = append(append(make([]byte, extraVanity), append(signers[0].Bytes(), signers[1].Bytes()...)...), make([]byte, extraSeal)...)
+
+		db, _ := ethdb.NewMemDatabase()
+		engine := New(config, db)
+		engine.Authorize(signers[0], nil)
+		if err := engine.VerifyGenesisConsistency(chain); (err != nil) != (test.limit > 2) {
+			t.Error("wrong genesis consistency check", "limit", test.limit, "err", err)
+		}
+
+		// Let the first masternode seal a few consecutive blocks
+		var err error
+		for i := 1; i <= 3 && err == nil; i++ {
+			parent := chain.headers[i-1]
+			header := &types.Header{
+				ParentHash: parent.Hash(),
+				Number:     big.NewInt(int64(i)),
+				Time:       new(big.Int).Add(parent.Time, big.NewInt(2)),
+				UncleHash:  uncleHash,
+				Extra:      make([]byte, extraVanity+extraSeal),
+			}
+			header.Difficulty = engine.calcDifficulty(chain, parent, signers[0])
+			if i > 1 {
+				_, seal, dryErr := engine.DryRunSeal(chain, types.NewBlockWithHeader(header))
+				if dryErr != nil || seal != test.seal {
+					t.Fatal("wrong dry run", "limit", test.limit, "want", test.seal, "have", seal, "err", dryErr)
+				}
+			}
+			sealTestHeader(t, header, keys[0])
+			chain.headers = append(chain.headers[:i], header)
+			err = engine.verifyHeaderWithCache(chain, header, nil, false)
+		}
+		if test.seal && err != nil {
+			t.Error("consecutive blocks should be accepted", "limit", test.limit, "err", err)
+		}
+		if !test.seal && err != errUnauthorized {
+			t.Error("consecutive blocks should be rejected", "limit", test.limit, "want", errUnauthorized, "have", err)
+		}
+	}
+}
+
+func TestUpdateMasternodesSignerLimit(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5, RecentSignerLimit: 3}
+	keys, signers := newTestSigners(t, 5)
+	chain := newTestChain(t, config, keys, 5)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	if err := engine.VerifyGenesisConsistency(chain); err != nil {
+		t.Fatal("limit should fit the recent signers of 5 masternodes", "err", err)
+	}
+	// Three masternodes only keep two recent signers, below the limit
+	ms := []Masternode{{Address: signers[0], Stake: big.NewInt(1)}, {Address: signers[1], Stake: big.NewInt(1)}, {Address: signers[2], Stake: big.NewInt(1)}}
+	if err := engine.UpdateMasternodes(chain, chain.CurrentHeader(), ms); err == nil {
+		t.Error("masternodes not keeping enough recent signers should be rejected")
+	}
+	snap, err := engine.GetSnapshot(chain, chain.CurrentHeader())
+	if err != nil {
+		t.Fatal("can't get snapshot", "err", err)
+	}
+	if len(snap.Signers) != 5 {
+		t.Error("rejected masternodes shouldn't change the snapshot", "want", 5, "have", len(snap.Signers))
+	}
+	// Four masternodes keep three
+	if err := engine.UpdateMasternodes(chain, chain.CurrentHeader(), append(ms, Masternode{Address: signers[3], Stake: big.NewInt(1)})); err != nil {
+		t.Error("can't update masternodes", "err", err)
+	}
+}
+
+func TestInvalidateVerifiedHeader(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, _ := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 3)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	orphan := chain.headers[3]
+	if err := engine.VerifyHeader(chain, orphan, false); err != nil {
+		t.Fatal("can't verify header", "err", err)
+	}
+	// Reorg the header out of the chain, dropping its parent as well
+	engine.InvalidateVerifiedHeader(orphan.Hash())
+	chain.headers = chain.headers[:2]
+	if err := engine.VerifyHeader(chain, orphan, false); err != consensus.ErrUnknownAncestor {
+		t.Error("orphaned header should be verified again", "want", consensus.ErrUnknownAncestor, "have", err)
+	}
+}
+
+func TestSigningTxCounts(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	signTx := func(nonce uint64, key *ecdsa.PrivateKey) *types.Transaction {
+		tx, err := types.SignTx(newTestSigningTx(nonce), types.HomesteadSigner{}, key)
+		if err != nil {
+			t.Fatal("can't sign transaction", "err", err)
+		}
+		return tx
+	}
+	// Block 3 isn't cached, its signing transactions are read from the block
+	base := newTestChain(t, config, keys, 3)
+	other, _ := types.SignTx(types.NewTransaction(0, common.HexToAddress("0x01"), big.NewInt(1), 21000, big.NewInt(0), nil), types.HomesteadSigner{}, keys[2])
+	block := types.NewBlock(base.headers[3], []*types.Transaction{signTx(2, keys[0]), other}, nil, nil)
+	base.headers[3] = block.Header()
+	chain := &testBlockChainReader{*base, block}
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	engine.BlockSigners.Add(chain.headers[1].Hash(), []*types.Transaction{signTx(0, keys[0]), signTx(0, keys[1])})
+	engine.BlockSigners.Add(chain.headers[2].Hash(), []*types.Transaction{signTx(1, keys[0])})
+
+	counts, err := engine.SigningTxCounts(chain, 0)
+	if err != nil {
+		t.Fatal("can't count signing transactions", "err", err)
+	}
+	if want := map[common.Address]int{signers[0]: 3, signers[1]: 1, signers[2]: 0}; !reflect.DeepEqual(counts, want) {
+		t.Error("wrong signing transaction counts", "want", want, "have", counts)
+	}
+	if _, err := engine.SigningTxCounts(chain, 1); err != errUnknownBlock {
+		t.Error("future epoch should be refused", "want", errUnknownBlock, "have", err)
+	}
+}
@@ -16,6 +16,8 @@
 package XDPoS
 
 import (
+	"encoding/json"
+
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus"
 	"github.com/ethereum/go-ethereum/core/types"
@@ -98,3 +100,72 @@ func (api *API) Proposals() map[common.Address]bool {
 	}
 	return proposals
 }
+
+// Propose injects a new authorization proposal that the signer will attempt to
+// push through. New proposals are refused once the signer is already pushing the
+// maximum number of them, updating an existing one is always allowed.
+func (api *API) Propose(address common.Address, auth bool) error {
+	api.XDPoS.lock.Lock()
+	defer api.XDPoS.lock.Unlock()
+
+	if _, ok := api.XDPoS.proposals[address]; !ok && len(api.XDPoS.proposals) >= api.XDPoS.MaxProposals {
+		return errTooManyProposals
+	}
+	api.XDPoS.proposals[address] = auth
+	return nil
+}
+
+// Discard drops a currently running proposal, stopping the signer from casting
+// further votes (either for or against).
+func (api *API) Discard(address common.Address) {
+	api.XDPoS.lock.Lock()
+	defer api.XDPoS.lock.Unlock()
+
+	delete(api.XDPoS.proposals, address)
+}
+
+// GetCandidateVoteHistory retrieves the votes cast on a candidate since the start
+// of the given epoch.
+func (api *API) GetCandidateVoteHistory(address common.Address, fromEpoch uint64) ([]VoteRecord, error) {
+	return api.XDPoS.CandidateVoteHistory(api.chain, address, fromEpoch)
+}
+
+// GetSnapshotProvenance retrieves where the snapshot of a given block comes from.
+func (api *API) GetSnapshotProvenance(hash common.Hash) (*ProvenanceReport, error) {
+	header := api.chain.GetHeaderByHash(hash)
+	if header == nil {
+		return nil, errUnknownBlock
+	}
+	return api.XDPoS.SnapshotProvenance(api.chain, header.Number.Uint64(), hash)
+}
+
+// AttestMasternodeSet signs an attestation of the masternode set in effect at the
+// current head with the local signer.
+func (api *API) AttestMasternodeSet() (*SignedAttestation, error) {
+	header := api.chain.CurrentHeader()
+	if header == nil {
+		return nil, errUnknownBlock
+	}
+	return api.XDPoS.AttestMasternodeSet(api.chain, header)
+}
+
+// GetSnapshotJSON retrieves the serialized snapshot of a given block.
+func (api *API) GetSnapshotJSON(hash common.Hash) (json.RawMessage, error) {
+	return api.XDPoS.SnapshotJSON(hash)
+}
+
+// GetMintingSchedule retrieves whether the signer is scheduled to mint the block
+// on top of the specified one, and how far its turn is.
+func (api *API) GetMintingSchedule(number *rpc.BlockNumber, signer common.Address) (*MintingSchedule, error) {
+	// Retrieve the requested block number (or current if none requested)
+	var header *types.Header
+	if number == nil || *number == rpc.LatestBlockNumber {
+		header = api.chain.CurrentHeader()
+	} else {
+		header = api.chain.GetHeaderByNumber(uint64(number.Int64()))
+	}
+	if header == nil {
+		return nil, errUnknownBlock
+	}
+	return api.XDPoS.GetMintingSchedule(api.chain, header, signer)
+}
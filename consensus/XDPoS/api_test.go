@@ -0,0 +1,248 @@
+package XDPoS
+
+import (
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+func TestProposalsCap(t *testing.T) {
+	config := &params.XDPoSConfig{Epoch: 900}
+	engine := New(config, nil)
+	engine.MaxProposals = 2
+	api := &API{XDPoS: engine}
+
+	first := common.StringToAddress("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	second := common.StringToAddress("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	third := common.StringToAddress("cccccccccccccccccccccccccccccccccccccccc")
+	for _, address := range []common.Address{first, second} {
+		if err := api.Propose(address, true); err != nil {
+			t.Fatal("proposal below the cap should be accepted", "address", address, "err", err)
+		}
+	}
+	if err := api.Propose(third, true); err != errTooManyProposals {
+		t.Error("proposal past the cap should be rejected", "want", errTooManyProposals, "have", err)
+	}
+	if err := api.Propose(first, false); err != nil {
+		t.Error("updating an existing proposal should be accepted", "err", err)
+	}
+	snap := newSnapshot(config, nil, 0, common.Hash{}, []common.Address{first})
+	proposals := api.Proposals()
+	if len(proposals) != 2 {
+		t.Error("wrong number of proposals", "want", 2, "have", len(proposals))
+	}
+	for address, auth := range proposals {
+		if !snap.validVote(address, auth) {
+			t.Error("existing proposal should remain votable", "address", address, "auth", auth)
+		}
+	}
+	api.Discard(second)
+	if err := api.Propose(third, true); err != nil {
+		t.Error("proposal should be accepted after discarding one", "err", err)
+	}
+}
+
+func TestCandidateVoteHistory(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 0)
+
+	var authNonce types.BlockNonce
+	copy(authNonce[:], nonceAuthVote)
+	candidate, other := common.HexToAddress("0x01"), common.HexToAddress("0x02")
+	votes := []struct {
+		coinbase common.Address
+		nonce    types.BlockNonce
+	}{
+		{common.Address{}, types.BlockNonce{}},
+		{candidate, authNonce},
+		{other, authNonce},
+		{candidate, types.BlockNonce{}},
+		{candidate, authNonce},
+	}
+	for i, vote := range votes {
+		parent := chain.CurrentHeader()
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     big.NewInt(int64(i + 1)),
+			Coinbase:   vote.coinbase,
+			Nonce:      vote.nonce,
+			Difficulty: big.NewInt(3),
+			Time:       new(big.Int).Add(parent.Time, new(big.Int).SetUint64(config.Period)),
+			UncleHash:  uncleHash,
+			Extra:      make([]byte, extraVanity+extraSeal),
+		}
+		sealTestHeader(t, header, keys[i%len(keys)])
+		chain.headers = append(chain.headers, header)
+	}
+	db, _ := ethdb.NewMemDatabase()
+	history, err := New(config, db).CandidateVoteHistory(chain, candidate, 0)
+	if err != nil {
+		t.Fatal("can't get vote history", "err", err)
+	}
+	want := []VoteRecord{
+		{Block: 2, Signer: signers[1], Authorize: true},
+		{Block: 4, Signer: signers[0], Authorize: false},
+		{Block: 5, Signer: signers[1], Authorize: true},
+	}
+	if !reflect.DeepEqual(history, want) {
+		t.Error("wrong vote history", "want", want, "have", history)
+	}
+}
+
+func TestSnapshotProvenance(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 10, Gap: 3}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 9)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	gap := chain.headers[7]
+
+	// Nothing cached nor stored yet, the snapshot is recomputed
+	report, err := engine.SnapshotProvenance(chain, 7, gap.Hash())
+	if err != nil {
+		t.Fatal("can't get provenance", "err", err)
+	}
+	if report.Source != SnapshotFromRecompute || report.Memory != nil || report.Disk != nil {
+		t.Error("snapshot should be recomputed", "report", report)
+	}
+	if !reflect.DeepEqual(report.Recomputed, signers) || !reflect.DeepEqual(report.Masternodes, signers) {
+		t.Error("wrong recomputed signers", "report", report)
+	}
+	// Retrieving the snapshot caches it in memory and stores it at the gap
+	if _, err := engine.GetSnapshot(chain, gap); err != nil {
+		t.Fatal("can't get snapshot", "err", err)
+	}
+	if report, _ = engine.SnapshotProvenance(chain, 7, gap.Hash()); report.Source != SnapshotFromMemory || report.Memory == nil || report.Disk == nil {
+		t.Error("snapshot should be taken from memory", "report", report)
+	}
+	// Once evicted from memory, the stored snapshot is used, even if diverging
+	snap, _ := engine.GetSnapshot(chain, gap)
+	snap = snap.copy()
+	delete(snap.Signers, signers[0])
+	engine.StoreSnapshot(snap)
+	engine.recents.Purge()
+
+	if report, _ = engine.SnapshotProvenance(chain, 7, gap.Hash()); report.Source != SnapshotFromDisk || report.Memory != nil {
+		t.Error("snapshot should be loaded from disk", "report", report)
+	}
+	if !reflect.DeepEqual(report.Disk, signers[1:]) || !reflect.DeepEqual(report.Recomputed, signers) {
+		t.Error("diverging sources should be reported", "report", report)
+	}
+	// The contract is reported alongside the snapshots once readable
+	engine.HookGetSignersFromContract = func(hash common.Hash) ([]common.Address, error) {
+		return signers[:2], nil
+	}
+	if report, _ = engine.SnapshotProvenance(chain, 7, gap.Hash()); report.Source != SnapshotFromDisk || !reflect.DeepEqual(report.Contract, signers[:2]) {
+		t.Error("contract masternodes should be reported", "report", report)
+	}
+	// Without any snapshot to load nor the headers to recompute one, the engine
+	// falls back to the contract
+	head := chain.headers[9]
+	chain.headers[3] = &types.Header{Number: big.NewInt(3), Extra: make([]byte, extraVanity+extraSeal)}
+	report, err = engine.SnapshotProvenance(chain, 9, head.Hash())
+	if err != nil {
+		t.Fatal("can't get provenance", "err", err)
+	}
+	if report.Source != SnapshotFromContract || report.Recomputed != nil || !reflect.DeepEqual(report.Contract, signers[:2]) {
+		t.Error("masternodes should be taken from the contract", "report", report)
+	}
+	engine.HookGetSignersFromContract = nil
+	if _, err := engine.SnapshotProvenance(chain, 9, head.Hash()); err == nil {
+		t.Error("provenance without any source should fail")
+	}
+}
+
+func TestAttestMasternodeSet(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 10, Gap: 3}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 5)
+
+	engine := New(config, nil)
+	if _, err := engine.AttestMasternodeSet(chain, chain.CurrentHeader()); err != errNoSignFn {
+		t.Error("attestation without signer should fail", "want", errNoSignFn, "have", err)
+	}
+	engine.Authorize(signers[1], func(account accounts.Account, hash []byte) ([]byte, error) {
+		return crypto.Sign(hash, keys[1])
+	})
+	attestation, err := engine.AttestMasternodeSet(chain, chain.CurrentHeader())
+	if err != nil {
+		t.Fatal("can't attest masternode set", "err", err)
+	}
+	if attestation.Number != 5 || attestation.SetHash != masternodeSetHash(signers) {
+		t.Error("wrong attestation", "attestation", attestation)
+	}
+	signer, err := VerifyAttestation(attestation)
+	if err != nil || signer != signers[1] {
+		t.Error("wrong attestation signer", "want", signers[1], "have", signer, "err", err)
+	}
+	// Tampering with the attested set changes the recovered signer
+	attestation.SetHash = common.Hash{}
+	if signer, err := VerifyAttestation(attestation); err == nil && signer == signers[1] {
+		t.Error("tampered attestation should not verify")
+	}
+}
+
+func TestSnapshotJSON(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 10, Gap: 3}
+	keys, _ := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 8)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	if _, err := engine.SnapshotJSON(chain.headers[7].Hash()); err != errUnknownBlock {
+		t.Error("unknown snapshot should be reported", "want", errUnknownBlock, "have", err)
+	}
+	// Both the stored gap snapshot and the in-memory one of block 8 are served
+	for _, header := range chain.headers[7:9] {
+		snap, err := engine.GetSnapshot(chain, header)
+		if err != nil {
+			t.Fatal("can't get snapshot", "err", err)
+		}
+		blob, err := engine.SnapshotJSON(header.Hash())
+		if err != nil {
+			t.Fatal("can't get snapshot JSON", "number", header.Number, "err", err)
+		}
+		decoded := new(Snapshot)
+		if err := json.Unmarshal(blob, decoded); err != nil {
+			t.Fatal("can't decode snapshot JSON", "err", err)
+		}
+		if want, have := snap.CanonicalHash(), decoded.CanonicalHash(); want != have {
+			t.Error("decoded snapshot differs", "number", header.Number, "want", want, "have", have)
+		}
+	}
+}
+
+func TestGetMintingSchedule(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 3)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	for _, test := range []struct {
+		signer   common.Address
+		schedule MintingSchedule
+	}{
+		{signers[0], MintingSchedule{Masternodes: 3, PreIndex: 2, CurIndex: 0, Hop: 0, Turn: true}},
+		{signers[1], MintingSchedule{Masternodes: 3, PreIndex: 2, CurIndex: 1, Hop: 1, Turn: false}},
+		{common.StringToAddress("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), MintingSchedule{Masternodes: 3, PreIndex: 2, CurIndex: -1, Hop: -1, Turn: false}},
+	} {
+		schedule, err := engine.GetMintingSchedule(chain, chain.CurrentHeader(), test.signer)
+		if err != nil {
+			t.Fatal("can't get minting schedule", "signer", test.signer, "err", err)
+		}
+		if *schedule != test.schedule {
+			t.Error("wrong minting schedule", "signer", test.signer, "want", test.schedule, "have", *schedule)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2018 XDCchain
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package XDPoS
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// verifyErrorsLimit is the number of recent header verification failures kept.
+const verifyErrorsLimit = 32
+
+// EngineMetricsSnapshot is a point in time view of the engine internal counters.
+type EngineMetricsSnapshot struct {
+	SnapshotsComputed    uint64 `json:"snapshotsComputed"`    // Number of snapshots derived by applying headers
+	HeadersVerified      uint64 `json:"headersVerified"`      // Number of headers successfully verified
+	SignatureCacheHits   uint64 `json:"signatureCacheHits"`   // Number of signers found in the signatures cache
+	SignatureCacheMisses uint64 `json:"signatureCacheMisses"` // Number of signers which had to be recovered
+	SignatureCacheLen    int    `json:"signatureCacheLen"`    // Number of signers currently cached
+	RecentsCacheHits     uint64 `json:"recentsCacheHits"`     // Number of snapshots found in memory
+	RecentsCacheMisses   uint64 `json:"recentsCacheMisses"`   // Number of snapshots missing from memory
+	RecentsCacheLen      int    `json:"recentsCacheLen"`      // Number of snapshots currently kept in memory
+}
+
+// engineCounters holds the engine activity counters, updated atomically.
+type engineCounters struct {
+	snapshotsComputed uint64
+	headersVerified   uint64
+}
+
+// countingCache is an ARC cache keeping track of its hits and misses.
+type countingCache struct {
+	hits   uint64 // Accessed atomically, keep 64 bit aligned
+	misses uint64
+
+	*lru.ARCCache
+}
+
+// newCountingCache creates a counting ARC cache of the given size.
+func newCountingCache(size int) *countingCache {
+	cache, _ := lru.NewARC(size)
+	return &countingCache{ARCCache: cache}
+}
+
+// Get looks up a key's value from the cache, counting the hit or miss.
+func (c *countingCache) Get(key interface{}) (interface{}, bool) {
+	value, ok := c.ARCCache.Get(key)
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	return value, ok
+}
+
+// EngineMetrics returns a snapshot of the engine internal counters.
+func (c *XDPoS) EngineMetrics() EngineMetricsSnapshot {
+	return EngineMetricsSnapshot{
+		SnapshotsComputed:    atomic.LoadUint64(&c.counters.snapshotsComputed),
+		HeadersVerified:      atomic.LoadUint64(&c.counters.headersVerified),
+		SignatureCacheHits:   atomic.LoadUint64(&c.signatures.hits),
+		SignatureCacheMisses: atomic.LoadUint64(&c.signatures.misses),
+		SignatureCacheLen:    c.signatures.Len(),
+		RecentsCacheHits:     atomic.LoadUint64(&c.recents.hits),
+		RecentsCacheMisses:   atomic.LoadUint64(&c.recents.misses),
+		RecentsCacheLen:      c.recents.Len(),
+	}
+}
+
+// VerifyErrorRecord is a header verification failure.
+type VerifyErrorRecord struct {
+	Number uint64      `json:"number"` // Number of the rejected header
+	Hash   common.Hash `json:"hash"`   // Hash of the rejected header
+	Error  string      `json:"error"`  // Reason of the rejection
+}
+
+// verifyErrorRing keeps the most recent header verification failures.
+type verifyErrorRing struct {
+	records []VerifyErrorRecord // Failures kept, overwritten from the oldest once full
+	next    int                 // Index the next failure is written at once full
+	lock    sync.Mutex
+}
+
+// add records a verification failure, dropping the oldest one if full.
+func (r *verifyErrorRing) add(record VerifyErrorRecord) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.records) < verifyErrorsLimit {
+		r.records = append(r.records, record)
+		return
+	}
+	r.records[r.next] = record
+	r.next = (r.next + 1) % verifyErrorsLimit
+}
+
+// list returns the recorded failures, oldest first.
+func (r *verifyErrorRing) list() []VerifyErrorRecord {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	records := make([]VerifyErrorRecord, 0, len(r.records))
+	records = append(records, r.records[r.next:]...)
+	return append(records, r.records[:r.next]...)
+}
+
+// RecentVerifyErrors returns the most recent header verification failures,
+// oldest first, to find out why blocks of peers are rejected.
+func (c *XDPoS) RecentVerifyErrors() []VerifyErrorRecord {
+	return c.verifyErrors.list()
+}
@@ -0,0 +1,111 @@
+package XDPoS
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/hashicorp/golang-lru"
+)
+
+func TestEngineMetrics(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, _ := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 6)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	if metrics := engine.EngineMetrics(); metrics != (EngineMetricsSnapshot{}) {
+		t.Error("fresh engine should have no activity", "metrics", metrics)
+	}
+	head := chain.CurrentHeader()
+	if _, err := engine.snapshot(chain, head.Number.Uint64(), head.Hash(), nil); err != nil {
+		t.Fatal("can't get snapshot", "err", err)
+	}
+	if _, err := engine.snapshot(chain, head.Number.Uint64(), head.Hash(), nil); err != nil {
+		t.Fatal("can't get snapshot", "err", err)
+	}
+	engine.Author(head)
+	engine.Author(head)
+
+	metrics := engine.EngineMetrics()
+	if metrics.SnapshotsComputed != 1 {
+		t.Error("wrong number of computed snapshots", "want", 1, "have", metrics.SnapshotsComputed)
+	}
+	if metrics.RecentsCacheHits != 1 || metrics.RecentsCacheLen != 1 {
+		t.Error("wrong recents cache stats", "hits", metrics.RecentsCacheHits, "len", metrics.RecentsCacheLen)
+	}
+	// Applying the headers recovered each signer once, then the author was cached
+	if metrics.SignatureCacheMisses != 6 || metrics.SignatureCacheHits != 2 || metrics.SignatureCacheLen != 6 {
+		t.Error("wrong signature cache stats", "hits", metrics.SignatureCacheHits, "misses", metrics.SignatureCacheMisses, "len", metrics.SignatureCacheLen)
+	}
+	if metrics.HeadersVerified != 1 {
+		t.Error("genesis should have been verified", "have", metrics.HeadersVerified)
+	}
+}
+
+func TestSharedSignatureCache(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 1)
+
+	shared, _ := lru.NewARC(inmemorySnapshots)
+	db, _ := ethdb.NewMemDatabase()
+	verifier := NewWithSignatureCache(config, db, shared)
+	engine := NewWithSignatureCache(config, db, shared)
+	for _, e := range []*XDPoS{verifier, engine} {
+		author, err := e.Author(chain.headers[1])
+		if err != nil || author != signers[0] {
+			t.Fatal("wrong author", "want", signers[0], "have", author, "err", err)
+		}
+	}
+	if metrics := engine.EngineMetrics(); metrics.SignatureCacheHits != 1 || metrics.SignatureCacheMisses != 0 {
+		t.Error("author should be served from the shared cache", "hits", metrics.SignatureCacheHits, "misses", metrics.SignatureCacheMisses)
+	}
+	if private := NewWithSignatureCache(config, db, nil); private.signatures.ARCCache == shared {
+		t.Error("engine without shared cache should use a private one")
+	}
+}
+
+func TestRecentVerifyErrors(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, _ := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 3)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	if err := engine.VerifyHeader(chain, chain.headers[1], false); err != nil {
+		t.Fatal("can't verify header", "err", err)
+	}
+	if records := engine.RecentVerifyErrors(); len(records) != 0 {
+		t.Error("valid header shouldn't be recorded", "records", records)
+	}
+	// Headers with unknown parents are rejected, only the most recent ones are kept
+	var rejected []*types.Header
+	for i := 1; i <= verifyErrorsLimit+8; i++ {
+		header := &types.Header{
+			ParentHash: common.HexToHash("0x01"),
+			Number:     big.NewInt(int64(i)),
+			Time:       big.NewInt(0),
+			UncleHash:  uncleHash,
+			Extra:      make([]byte, extraVanity+extraSeal),
+		}
+		if err := engine.VerifyHeader(chain, header, false); err == nil {
+			t.Fatal("header with unknown parent should be rejected", "number", i)
+		}
+		rejected = append(rejected, header)
+	}
+	records := engine.RecentVerifyErrors()
+	if len(records) != verifyErrorsLimit {
+		t.Fatal("wrong number of records", "want", verifyErrorsLimit, "have", len(records))
+	}
+	for i, record := range records {
+		header := rejected[8+i]
+		if record.Number != header.Number.Uint64() || record.Hash != header.Hash() || record.Error == "" {
+			t.Error("wrong record", "index", i, "want", header.Number, "have", record.Number, "error", record.Error)
+		}
+	}
+}
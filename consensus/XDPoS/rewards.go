@@ -0,0 +1,114 @@
+// Copyright (c) 2018 XDCchain
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package XDPoS
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// rewardFile is a reward map of a block pending to be saved.
+type rewardFile struct {
+	header  *types.Header
+	rewards map[string]interface{}
+}
+
+// rewardWriter saves the reward maps into the reward folder in the background,
+// so that finalizing a reward checkpoint doesn't wait for the disk.
+type rewardWriter struct {
+	queue  chan rewardFile // Reward maps waiting to be saved, nil until started
+	closed bool            // Whether the writer was closed, saving synchronously
+	lock   sync.Mutex      // Protects the queue and the closed flag
+	wg     sync.WaitGroup  // Tracks the background writer
+
+	write func(filename string, data []byte) error // Sink of the marshalled reward maps
+}
+
+// newRewardWriter creates a reward writer saving the reward maps as files.
+func newRewardWriter() *rewardWriter {
+	return &rewardWriter{
+		write: func(filename string, data []byte) error {
+			return ioutil.WriteFile(filename, data, 0644)
+		},
+	}
+}
+
+// save queues the reward map of a block to be saved, starting the background
+// writer with the given queue size on first use. It only blocks if the queue
+// is full, and saves synchronously once the writer is closed.
+func (w *rewardWriter) save(header *types.Header, rewards map[string]interface{}, queueSize int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	file := rewardFile{header: header, rewards: rewards}
+	if w.closed {
+		w.store(file)
+		return
+	}
+	if w.queue == nil {
+		w.queue = make(chan rewardFile, queueSize)
+		w.wg.Add(1)
+		go w.loop()
+	}
+	w.queue <- file
+}
+
+// loop saves the queued reward maps until the writer is closed.
+func (w *rewardWriter) loop() {
+	defer w.wg.Done()
+
+	for file := range w.queue {
+		w.store(file)
+	}
+}
+
+// store marshals a reward map and writes it into the reward folder.
+func (w *rewardWriter) store(file rewardFile) {
+	data, err := json.Marshal(file.rewards)
+	if err == nil {
+		err = w.write(filepath.Join(common.StoreRewardFolder, file.header.Number.String()+"."+file.header.Hash().Hex()), data)
+	}
+	if err != nil {
+		log.Error("Error when save reward info ", "number", file.header.Number, "hash", file.header.Hash().Hex(), "err", err)
+	}
+}
+
+// close stops the background writer once all the queued reward maps are saved.
+func (w *rewardWriter) close() {
+	w.lock.Lock()
+	if !w.closed {
+		w.closed = true
+		if w.queue != nil {
+			close(w.queue)
+		}
+	}
+	w.lock.Unlock()
+
+	w.wg.Wait()
+}
+
+// Close flushes the reward maps waiting to be saved and stops the background
+// writer. Reward maps of blocks finalized afterwards are saved synchronously.
+func (c *XDPoS) Close() error {
+	c.rewards.close()
+	return nil
+}
@@ -0,0 +1,167 @@
+package XDPoS
+
+import (
+	"bytes"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+func TestNextRewardBlocks(t *testing.T) {
+	engine := New(&params.XDPoSConfig{Epoch: 900, RewardCheckpoint: 900}, nil)
+	for _, test := range []struct {
+		number uint64
+		count  int
+		want   []uint64
+	}{
+		{0, 3, []uint64{900, 1800, 2700}},
+		{899, 2, []uint64{900, 1800}},
+		{900, 2, []uint64{1800, 2700}},
+		{3464018, 1, []uint64{3464100}},
+		{10, 0, nil},
+	} {
+		if have := engine.NextRewardBlocks(test.number, test.count); !reflect.DeepEqual(have, test.want) {
+			t.Error("wrong reward blocks", "number", test.number, "want", test.want, "have", have)
+		}
+	}
+	if have := New(&params.XDPoSConfig{Epoch: 900}, nil).NextRewardBlocks(10, 3); have != nil {
+		t.Error("no reward blocks without reward checkpoint", "have", have)
+	}
+}
+
+// testStateChainReader is a testChainReader additionally serving empty states.
+type testStateChainReader struct {
+	*testChainReader
+	db ethdb.Database
+}
+
+func (r *testStateChainReader) StateAt(root common.Hash) (*state.StateDB, error) {
+	return state.New(root, state.NewDatabase(r.db))
+}
+
+func TestEstimateMasternodeRewards(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 5, Gap: 2, RewardCheckpoint: 5}
+	keys, signers := newTestSigners(t, 3)
+	db, _ := ethdb.NewMemDatabase()
+	chain := &testStateChainReader{newTestChain(t, config, keys, 10), db}
+
+	engine := New(config, db)
+	engine.HookReward = func(chain consensus.ChainReader, state *state.StateDB, header *types.Header) (error, map[string]interface{}) {
+		// Every masternode earns its owner 3 and the foundation 1 per block number
+		rewards := make(map[common.Address]interface{})
+		for _, signer := range signers {
+			rewards[signer] = map[common.Address]*big.Int{
+				signer:                   new(big.Int).Mul(header.Number, big.NewInt(3)),
+				common.HexToAddress("f"): new(big.Int).Set(header.Number),
+			}
+		}
+		return nil, map[string]interface{}{"rewards": rewards}
+	}
+	total, err := engine.EstimateMasternodeRewards(chain, signers[1], 0, 2)
+	if err != nil {
+		t.Fatal("can't estimate rewards", "err", err)
+	}
+	// Rewards are given at blocks 5 and 10
+	if want := big.NewInt(4*5 + 4*10); total.Cmp(want) != 0 {
+		t.Error("wrong estimated rewards", "want", want, "have", total)
+	}
+	if total, err := engine.EstimateMasternodeRewards(chain, common.HexToAddress("0x01"), 1, 2); err != nil || total.Sign() != 0 {
+		t.Error("non-masternode should earn nothing", "total", total, "err", err)
+	}
+	if _, err := engine.EstimateMasternodeRewards(chain.testChainReader, signers[1], 1, 2); err == nil {
+		t.Error("chain without historical states should be refused")
+	}
+}
+
+func TestFinalizeSavesRewardsAsync(t *testing.T) {
+	defer func(folder string) { common.StoreRewardFolder = folder }(common.StoreRewardFolder)
+	common.StoreRewardFolder = "rewards"
+
+	config := &params.XDPoSConfig{Epoch: 900, RewardCheckpoint: 900}
+	chain := &testChainReader{config: &params.ChainConfig{ChainId: big.NewInt(1), XDPoS: config}}
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	engine.HookReward = func(chain consensus.ChainReader, state *state.StateDB, header *types.Header) (error, map[string]interface{}) {
+		return nil, map[string]interface{}{"signers": 1}
+	}
+	// Make the sink block until released
+	release, saved := make(chan struct{}), make(map[string][]byte)
+	engine.rewards.write = func(filename string, data []byte) error {
+		<-release
+		saved[filename] = data
+		return nil
+	}
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(db))
+	header := &types.Header{Number: big.NewInt(900)}
+
+	done := make(chan error)
+	go func() {
+		_, err := engine.Finalize(chain, header, statedb, nil, nil, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("can't finalize", "err", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("finalize blocked on the reward sink")
+	}
+	close(release)
+	engine.Close()
+
+	if len(saved) != 1 {
+		t.Fatal("reward should be saved on close", "saved", len(saved))
+	}
+	for filename, data := range saved {
+		if !bytes.HasPrefix([]byte(filename), []byte("rewards/900.")) || string(data) != `{"signers":1}` {
+			t.Error("wrong saved reward", "filename", filename, "data", string(data))
+		}
+	}
+}
+
+func TestRewardFairness(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 5, Gap: 2, RewardCheckpoint: 5}
+	keys, signers := newTestSigners(t, 3)
+	db, _ := ethdb.NewMemDatabase()
+	chain := &testStateChainReader{newTestChain(t, config, keys, 10), db}
+
+	engine := New(config, db)
+	engine.HookReward = func(chain consensus.ChainReader, state *state.StateDB, header *types.Header) (error, map[string]interface{}) {
+		// The i-th masternode earns i+1, split between its owner and the foundation
+		rewards := make(map[common.Address]interface{})
+		for i, signer := range signers {
+			rewards[signer] = map[common.Address]*big.Int{
+				signer:                   big.NewInt(int64(i)),
+				common.HexToAddress("f"): big.NewInt(1),
+			}
+		}
+		return nil, map[string]interface{}{"rewards": rewards}
+	}
+	report, err := engine.RewardFairness(chain, 0, 2)
+	if err != nil {
+		t.Fatal("can't compute reward fairness", "err", err)
+	}
+	// Rewards are given at blocks 5 and 10
+	want := map[common.Address]*big.Int{signers[0]: big.NewInt(2), signers[1]: big.NewInt(4), signers[2]: big.NewInt(6)}
+	if !reflect.DeepEqual(report.Totals, want) {
+		t.Error("wrong reward totals", "want", want, "have", report.Totals)
+	}
+	if gini := 4.0 / 18; report.Gini < gini-1e-9 || report.Gini > gini+1e-9 {
+		t.Error("wrong gini coefficient", "want", gini, "have", report.Gini)
+	}
+	if ratio := 1.0 / 3; report.MinMaxRatio < ratio-1e-9 || report.MinMaxRatio > ratio+1e-9 {
+		t.Error("wrong min/max ratio", "want", ratio, "have", report.MinMaxRatio)
+	}
+	if report, err := engine.RewardFairness(chain, 0, 0); err != nil || len(report.Totals) != 0 || report.Gini != 0 {
+		t.Error("range without rewards should be empty", "report", report, "err", err)
+	}
+}
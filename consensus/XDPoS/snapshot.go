@@ -18,13 +18,17 @@ package XDPoS
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/clique"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto/sha3"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/params"
-	lru "github.com/hashicorp/golang-lru"
+	"github.com/ethereum/go-ethereum/rlp"
 )
 
 // Vote represents a single vote that an authorized signer made to modify the
@@ -43,10 +47,73 @@ import (
 //	Votes     int  `json:"votes"`     // Number of votes until now wanting to pass the proposal
 //}
 
+// SnapshotStore is the persistent backend of the checkpoint snapshots, keyed by
+// the hash of the block they were created at.
+type SnapshotStore interface {
+	Put(hash common.Hash, blob []byte) error
+	Get(hash common.Hash) ([]byte, error)
+	Delete(hash common.Hash) error
+	Hashes() ([]common.Hash, error) // Hashes of all the stored snapshots
+}
+
+// snapshotPrefix is the prefix of the snapshot keys in the chain database.
+const snapshotPrefix = "XDPoS-"
+
+// dbSnapshotStore is the default snapshot store, persisting the snapshots into
+// the chain database.
+type dbSnapshotStore struct {
+	db ethdb.Database
+}
+
+// NewDBSnapshotStore creates a snapshot store backed by the given database.
+func NewDBSnapshotStore(db ethdb.Database) SnapshotStore {
+	return &dbSnapshotStore{db: db}
+}
+
+func (s *dbSnapshotStore) Put(hash common.Hash, blob []byte) error {
+	return s.db.Put(append([]byte(snapshotPrefix), hash[:]...), blob)
+}
+
+func (s *dbSnapshotStore) Get(hash common.Hash) ([]byte, error) {
+	return s.db.Get(append([]byte(snapshotPrefix), hash[:]...))
+}
+
+func (s *dbSnapshotStore) Delete(hash common.Hash) error {
+	return s.db.Delete(append([]byte(snapshotPrefix), hash[:]...))
+}
+
+// Hashes lists the stored snapshots by iterating over the keys of the database,
+// which only the concrete database implementations allow.
+func (s *dbSnapshotStore) Hashes() ([]common.Hash, error) {
+	var keys [][]byte
+	switch db := s.db.(type) {
+	case *ethdb.LDBDatabase:
+		it := db.NewIteratorWithPrefix([]byte(snapshotPrefix))
+		for it.Next() {
+			keys = append(keys, common.CopyBytes(it.Key()))
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return nil, err
+		}
+	case *ethdb.MemDatabase:
+		keys = db.Keys()
+	default:
+		return nil, errors.New("snapshot store can't list the database keys")
+	}
+	var hashes []common.Hash
+	for _, key := range keys {
+		if len(key) == len(snapshotPrefix)+common.HashLength && bytes.HasPrefix(key, []byte(snapshotPrefix)) {
+			hashes = append(hashes, common.BytesToHash(key[len(snapshotPrefix):]))
+		}
+	}
+	return hashes, nil
+}
+
 // Snapshot is the state of the authorization voting at a given point in time.
 type Snapshot struct {
 	config   *params.XDPoSConfig // Consensus engine parameters to fine tune behavior
-	sigcache *lru.ARCCache      // Cache of recent block signatures to speed up ecrecover
+	sigcache *countingCache      // Cache of recent block signatures to speed up ecrecover
 
 	Number  uint64                          `json:"number"`  // Block number where the snapshot was created
 	Hash    common.Hash                     `json:"hash"`    // Block hash where the snapshot was created
@@ -59,7 +126,7 @@ type Snapshot struct {
 // newSnapshot creates a new snapshot with the specified startup parameters. This
 // method does not initialize the set of recent signers, so only ever use if for
 // the genesis block.
-func newSnapshot(config *params.XDPoSConfig, sigcache *lru.ARCCache, number uint64, hash common.Hash, signers []common.Address) *Snapshot {
+func newSnapshot(config *params.XDPoSConfig, sigcache *countingCache, number uint64, hash common.Hash, signers []common.Address) *Snapshot {
 	snap := &Snapshot{
 		config:   config,
 		sigcache: sigcache,
@@ -75,9 +142,9 @@ func newSnapshot(config *params.XDPoSConfig, sigcache *lru.ARCCache, number uint
 	return snap
 }
 
-// loadSnapshot loads an existing snapshot from the database.
-func loadSnapshot(config *params.XDPoSConfig, sigcache *lru.ARCCache, db ethdb.Database, hash common.Hash) (*Snapshot, error) {
-	blob, err := db.Get(append([]byte("XDPoS-"), hash[:]...))
+// loadSnapshot loads an existing snapshot from the snapshot store.
+func loadSnapshot(config *params.XDPoSConfig, sigcache *countingCache, store SnapshotStore, hash common.Hash) (*Snapshot, error) {
+	blob, err := store.Get(hash)
 	if err != nil {
 		return nil, err
 	}
@@ -91,13 +158,70 @@ func loadSnapshot(config *params.XDPoSConfig, sigcache *lru.ARCCache, db ethdb.D
 	return snap, nil
 }
 
-// store inserts the snapshot into the database.
-func (s *Snapshot) store(db ethdb.Database) error {
+// store inserts the snapshot into the snapshot store.
+func (s *Snapshot) store(store SnapshotStore) error {
 	blob, err := json.Marshal(s)
 	if err != nil {
 		return err
 	}
-	return db.Put(append([]byte("XDPoS-"), s.Hash[:]...), blob)
+	return store.Put(s.Hash, blob)
+}
+
+// CanonicalHash returns a hash over the content of the snapshot, serialized in
+// a canonical order regardless of map iteration or vote arrival order, so that
+// snapshots computed by different nodes can be compared by a single value.
+func (s *Snapshot) CanonicalHash() (hash common.Hash) {
+	blocks := make([]uint64, 0, len(s.Recents))
+	for block := range s.Recents {
+		blocks = append(blocks, block)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+
+	recents := make([]interface{}, 0, len(blocks))
+	for _, block := range blocks {
+		recents = append(recents, []interface{}{block, s.Recents[block]})
+	}
+	votes := make([]*clique.Vote, len(s.Votes))
+	copy(votes, s.Votes)
+	sort.Slice(votes, func(i, j int) bool {
+		if votes[i].Block != votes[j].Block {
+			return votes[i].Block < votes[j].Block
+		}
+		if cmp := bytes.Compare(votes[i].Signer[:], votes[j].Signer[:]); cmp != 0 {
+			return cmp < 0
+		}
+		return bytes.Compare(votes[i].Address[:], votes[j].Address[:]) < 0
+	})
+	// The tally is derived from the votes, but it's hashed as well so that a
+	// snapshot with a corrupted tally doesn't compare equal to a healthy one.
+	addresses := make([]common.Address, 0, len(s.Tally))
+	for address := range s.Tally {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return bytes.Compare(addresses[i][:], addresses[j][:]) < 0
+	})
+	tally := make([]interface{}, 0, len(addresses))
+	for _, address := range addresses {
+		// Votes are hashed in two's complement, keeping invalid negative
+		// tallies apart from the valid ones
+		t := s.Tally[address]
+		tally = append(tally, []interface{}{address, t.Authorize, uint64(t.Votes)})
+	}
+	hasher := sha3.NewKeccak256()
+	if err := rlp.Encode(hasher, []interface{}{
+		s.Number,
+		s.Hash,
+		s.GetSigners(),
+		recents,
+		votes,
+		tally,
+	}); err != nil {
+		// Only fixed size fields and lists of them are encoded
+		panic(fmt.Sprintf("can't encode snapshot %x: %v", s.Hash, err))
+	}
+	hasher.Sum(hash[:0])
+	return hash
 }
 
 // copy creates a deep copy of the snapshot, though not the individual votes.
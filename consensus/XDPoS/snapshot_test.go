@@ -0,0 +1,284 @@
+package XDPoS
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/clique"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+func TestComputeSnapshot(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, signers := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 20)
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	head := chain.CurrentHeader()
+	want, err := engine.snapshot(chain, head.Number.Uint64(), head.Hash(), nil)
+	if err != nil {
+		t.Fatal("can't get snapshot", "err", err)
+	}
+	// Compute from a fresh engine on an empty database
+	emptydb, _ := ethdb.NewMemDatabase()
+	have, err := New(config, emptydb).ComputeSnapshot(chain, head.Number.Uint64(), head.Hash(), nil)
+	if err != nil {
+		t.Fatal("can't compute snapshot", "err", err)
+	}
+	if have.Number != want.Number || have.Hash != want.Hash {
+		t.Error("snapshot position mismatch", "want", want.Number, "have", have.Number)
+	}
+	if !reflect.DeepEqual(have.Signers, want.Signers) || !reflect.DeepEqual(have.Recents, want.Recents) {
+		t.Error("snapshot content mismatch", "want", want.GetSigners(), "have", have.GetSigners())
+	}
+	if !compareSignersLists(have.GetSigners(), signers) {
+		t.Error("wrong signers", "want", signers, "have", have.GetSigners())
+	}
+	if len(emptydb.Keys()) != 0 {
+		t.Error("computing a snapshot should not touch the database", "keys", len(emptydb.Keys()))
+	}
+	// Explicit parents must be consistent with the requested block
+	parents := chain.headers[1:]
+	if _, err := engine.ComputeSnapshot(chain, head.Number.Uint64(), common.Hash{}, parents); err != consensus.ErrUnknownAncestor {
+		t.Error("unknown ancestor should be rejected", "want", consensus.ErrUnknownAncestor, "have", err)
+	}
+}
+
+func TestSnapshotCanonicalHash(t *testing.T) {
+	config := &params.XDPoSConfig{Epoch: 900}
+	signers := []common.Address{
+		common.StringToAddress("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"),
+		common.StringToAddress("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"),
+		common.StringToAddress("cccccccccccccccccccccccccccccccccccccccc"),
+	}
+	candidate := common.StringToAddress("dddddddddddddddddddddddddddddddddddddddd")
+	votes := []*clique.Vote{
+		{Signer: signers[0], Block: 9, Address: candidate, Authorize: true},
+		{Signer: signers[1], Block: 9, Address: candidate, Authorize: true},
+		{Signer: signers[2], Block: 10, Address: signers[0], Authorize: false},
+	}
+	snap1 := newSnapshot(config, nil, 10, common.HexToHash("0x0a"), signers)
+	snap2 := newSnapshot(config, nil, 10, common.HexToHash("0x0a"), []common.Address{signers[2], signers[0], signers[1]})
+	for i := uint64(8); i <= 10; i++ {
+		snap1.Recents[i] = signers[i%3]
+	}
+	for i := uint64(10); i >= 8; i-- {
+		snap2.Recents[i] = signers[i%3]
+	}
+	for _, vote := range votes {
+		snap1.cast(vote.Address, vote.Authorize)
+		snap1.Votes = append(snap1.Votes, vote)
+	}
+	for i := len(votes) - 1; i >= 0; i-- {
+		snap2.cast(votes[i].Address, votes[i].Authorize)
+		snap2.Votes = append(snap2.Votes, votes[i])
+	}
+	if hash1, hash2 := snap1.CanonicalHash(), snap2.CanonicalHash(); hash1 != hash2 {
+		t.Error("same snapshot content should have the same canonical hash", "snap1", hash1, "snap2", hash2)
+	}
+	// A diverging tally must show up even if the votes are the same
+	snap2.Tally[candidate] = clique.Tally{Authorize: true, Votes: 1}
+	if snap1.CanonicalHash() == snap2.CanonicalHash() {
+		t.Error("different tallies should have different canonical hashes")
+	}
+	// A corrupted negative tally is hashed rather than rejected
+	snap2.Tally[candidate] = clique.Tally{Authorize: true, Votes: -2}
+	if snap1.CanonicalHash() == snap2.CanonicalHash() {
+		t.Error("negative tallies should have different canonical hashes")
+	}
+	snap2.Tally[candidate] = snap1.Tally[candidate]
+	snap2.Recents[10] = signers[0]
+	if snap1.CanonicalHash() == snap2.CanonicalHash() {
+		t.Error("different snapshot content should have different canonical hashes")
+	}
+}
+
+// testSnapshotStore is an in-memory snapshot store.
+type testSnapshotStore struct {
+	blobs map[common.Hash][]byte
+}
+
+func (s *testSnapshotStore) Put(hash common.Hash, blob []byte) error {
+	s.blobs[hash] = blob
+	return nil
+}
+
+func (s *testSnapshotStore) Get(hash common.Hash) ([]byte, error) {
+	blob, ok := s.blobs[hash]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return blob, nil
+}
+
+func (s *testSnapshotStore) Delete(hash common.Hash) error {
+	delete(s.blobs, hash)
+	return nil
+}
+
+func (s *testSnapshotStore) Hashes() ([]common.Hash, error) {
+	hashes := make([]common.Hash, 0, len(s.blobs))
+	for hash := range s.blobs {
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+func TestSnapshotStore(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, _ := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 4)
+
+	db, _ := ethdb.NewMemDatabase()
+	store := &testSnapshotStore{blobs: make(map[common.Hash][]byte)}
+	engine := NewWithSnapshotStore(config, db, store)
+	snap, err := engine.GetSnapshot(chain, chain.CurrentHeader())
+	if err != nil {
+		t.Fatal("can't get snapshot", "err", err)
+	}
+	// The genesis snapshot must have gone into the custom store only
+	genesis := chain.headers[0].Hash()
+	if _, ok := store.blobs[genesis]; !ok {
+		t.Error("genesis snapshot missing from the store")
+	}
+	if keys := db.Keys(); len(keys) != 0 {
+		t.Error("snapshots leaked into the chain database", "keys", len(keys))
+	}
+	if err := engine.StoreSnapshot(snap); err != nil {
+		t.Fatal("can't store snapshot", "err", err)
+	}
+	loaded, err := loadSnapshot(engine.config, engine.signatures, store, snap.Hash)
+	if err != nil {
+		t.Fatal("can't load snapshot", "err", err)
+	}
+	if want, have := snap.CanonicalHash(), loaded.CanonicalHash(); want != have {
+		t.Error("loaded snapshot differs", "want", want, "have", have)
+	}
+}
+
+func TestRebuildSnapshots(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 10, Gap: 3}
+	keys, signers := newTestSigners(t, 4)
+	chain := newTestChain(t, config, keys[:3], 9)
+
+	// A masternode joins at the first checkpoint, sealing in turn since then
+	for i := 10; i <= 20; i++ {
+		parent := chain.headers[i-1]
+		header := &types.Header{
+			ParentHash: parent.Hash(),
+			Number:     big.NewInt(int64(i)),
+			Difficulty: big.NewInt(4),
+			Time:       new(big.Int).Add(parent.Time, big.NewInt(2)),
+			UncleHash:  uncleHash,
+			Extra:      make([]byte, extraVanity+extraSeal),
+		}
+		key := keys[(i-10)%4]
+		if i%10 == 0 {
+			header.Extra = append(append(make([]byte, extraVanity), common.ExtractAddressToBytes(signers)...), make([]byte, extraSeal)...)
+			header.Validators = bytes.Repeat([]byte{'0', '0', '0', '1'}, len(signers))
+		}
+		if i == 10 {
+			header.Difficulty, key = big.NewInt(3), keys[0]
+		}
+		sealTestHeader(t, header, key)
+		chain.headers = append(chain.headers, header)
+	}
+	db, _ := ethdb.NewMemDatabase()
+	store := &testSnapshotStore{blobs: make(map[common.Hash][]byte)}
+	engine := NewWithSnapshotStore(config, db, store)
+
+	// The masternodes read from the contract are installed at the gap blocks
+	ms := make([]Masternode, len(signers))
+	for i, signer := range signers {
+		ms[i] = Masternode{Address: signer, Stake: big.NewInt(1)}
+	}
+	for _, gap := range []int{7, 17} {
+		if err := engine.UpdateMasternodes(chain, chain.headers[gap], ms); err != nil {
+			t.Fatal("can't update masternodes", "err", err)
+		}
+	}
+	checkpoint := chain.headers[20]
+	if err := engine.verifyHeader(chain, checkpoint, nil, false); err != nil {
+		t.Fatal("can't verify checkpoint", "err", err)
+	}
+	// Corrupt the stored gap snapshot, dropping the joining masternode, and leave
+	// a snapshot of a side fork behind
+	snap, err := engine.GetSnapshot(chain, chain.headers[17])
+	if err != nil {
+		t.Fatal("can't get snapshot", "err", err)
+	}
+	snap = snap.copy()
+	delete(snap.Signers, signers[3])
+	if err := engine.StoreSnapshot(snap); err != nil {
+		t.Fatal("can't store snapshot", "err", err)
+	}
+	side := common.HexToHash("0xdead")
+	store.Put(side, []byte("{}"))
+	engine.recents.Purge()
+	if err := engine.verifyHeader(chain, checkpoint, nil, false); err != errInvalidCheckpointSigners {
+		t.Fatal("corrupted snapshot should break verification", "want", errInvalidCheckpointSigners, "have", err)
+	}
+	// Rebuild from the checkpoint headers, then from the contract
+	for _, hook := range []func(common.Hash) ([]common.Address, error){nil, func(common.Hash) ([]common.Address, error) { return signers, nil }} {
+		engine.HookGetSignersFromContract = hook
+		if err := engine.RebuildSnapshots(chain, 19); err != nil {
+			t.Fatal("can't rebuild snapshots", "err", err)
+		}
+		if _, ok := store.blobs[side]; ok {
+			t.Error("side fork snapshot should be deleted")
+		}
+		if len(store.blobs) != 3 {
+			t.Error("wrong number of rebuilt snapshots", "want", 3, "have", len(store.blobs))
+		}
+		engine.recents.Purge()
+		if err := engine.verifyHeader(chain, checkpoint, nil, false); err != nil {
+			t.Error("verification should succeed after rebuild", "err", err)
+		}
+	}
+	// The gap snapshots can't be rebuilt without their masternodes
+	engine.HookGetSignersFromContract = nil
+	chain.headers = chain.headers[:18]
+	if err := engine.RebuildSnapshots(chain, 17); err == nil {
+		t.Error("rebuild without the masternodes of a gap should fail")
+	}
+	if len(store.blobs) != 3 {
+		t.Error("failed rebuild shouldn't touch the stored snapshots", "have", len(store.blobs))
+	}
+}
+
+func TestStructuralGenesis(t *testing.T) {
+	config := &params.XDPoSConfig{Period: 2, Epoch: 30, Gap: 5}
+	keys, _ := newTestSigners(t, 3)
+	chain := newTestChain(t, config, keys, 0)
+
+	// A custom genesis with a mix digest, which is valid for the engine to run
+	// on but doesn't pass the full header verification
+	genesis := types.CopyHeader(chain.headers[0])
+	genesis.MixDigest = common.HexToHash("0x01")
+	chain.headers[0] = genesis
+
+	db, _ := ethdb.NewMemDatabase()
+	engine := New(config, db)
+	if _, err := engine.GetSnapshot(chain, genesis); err != errInvalidMixDigest {
+		t.Error("custom genesis should fail full verification", "want", errInvalidMixDigest, "have", err)
+	}
+	engine.StructuralGenesis = true
+	if _, err := engine.GetSnapshot(chain, genesis); err != nil {
+		t.Error("custom genesis should pass structural verification", "err", err)
+	}
+	// Structural verification still rejects malformed genesis blocks
+	genesis.Extra = genesis.Extra[:extraVanity+1+extraSeal]
+	engine = New(config, db)
+	engine.StructuralGenesis = true
+	if _, err := engine.GetSnapshot(chain, genesis); err != errInvalidCheckpointSigners {
+		t.Error("malformed genesis should fail structural verification", "want", errInvalidCheckpointSigners, "have", err)
+	}
+}
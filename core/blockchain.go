@@ -1568,6 +1568,12 @@ func (bc *BlockChain) reorg(oldBlock, newBlock *types.Block) error {
 	} else {
 		log.Error("Impossible reorg, please file an issue", "oldnum", oldBlock.Number(), "oldhash", oldBlock.Hash(), "newnum", newBlock.Number(), "newhash", newBlock.Hash())
 	}
+	// Orphaned headers have to be verified again if they show up anew
+	if engine, ok := bc.Engine().(*XDPoS.XDPoS); ok {
+		for _, block := range oldChain {
+			engine.InvalidateVerifiedHeader(block.Hash())
+		}
+	}
 	// Insert the new chain, taking care of the proper incremental order
 	var addedTxs types.Transactions
 	for i := len(newChain) - 1; i >= 0; i-- {
@@ -163,6 +163,11 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 		eth.blockchain.SetHead(compat.RewindTo)
 		core.WriteChainConfig(chainDb, genesisHash, chainConfig)
 	}
+	if c, ok := eth.engine.(*XDPoS.XDPoS); ok {
+		if err := c.VerifyGenesisConsistency(eth.blockchain); err != nil {
+			return nil, fmt.Errorf("inconsistent XDPoS genesis: %v", err)
+		}
+	}
 	eth.bloomIndexer.Start(eth.blockchain)
 
 	if config.TxPool.Journal != "" {
@@ -236,6 +241,9 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 				return block, false, fmt.Errorf("can't get block creator: %v", err)
 			}
 			m2, err := c.GetValidator(m1, eth.blockchain, block.Header())
+			if err == XDPoS.ErrNoValidatorBeforeFirstEpoch {
+				return block, false, nil
+			}
 			if err != nil {
 				return block, false, fmt.Errorf("can't get block validator: %v", err)
 			}
@@ -500,6 +508,9 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 			return nil
 		}
 
+		// Hook reports whether the headers being verified come from a sync
+		c.HookSyncing = eth.protocolManager.downloader.Synchronising
+
 		eth.txPool.IsSigner = func(address common.Address) bool {
 			currentHeader := eth.blockchain.CurrentHeader()
 			header := currentHeader
@@ -736,6 +747,10 @@ func (s *Ethereum) StartStaking(local bool) error {
 			return fmt.Errorf("signer missing: %v", err)
 		}
 		XDPoS.Authorize(eb, wallet.SignHash)
+		if err := XDPoS.CanSign(); err != nil {
+			log.Error("Etherbase account can't sign blocks", "err", err)
+			return fmt.Errorf("signer unusable: %v", err)
+		}
 	}
 	if local {
 		// If local (CPU) mining is started, we can disable the transaction rejection
@@ -813,6 +828,9 @@ func (s *Ethereum) Stop() error {
 	}
 	s.txPool.Stop()
 	s.miner.Stop()
+	if c, ok := s.engine.(*XDPoS.XDPoS); ok {
+		c.Close()
+	}
 	s.eventMux.Stop()
 
 	s.chainDb.Close()
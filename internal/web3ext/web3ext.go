@@ -141,6 +141,42 @@ web3._extend({
 			call: 'XDPoS_getSignersAtHash',
 			params: 1
 		}),
+		new web3._extend.Method({
+			name: 'propose',
+			call: 'XDPoS_propose',
+			params: 2
+		}),
+		new web3._extend.Method({
+			name: 'discard',
+			call: 'XDPoS_discard',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'getCandidateVoteHistory',
+			call: 'XDPoS_getCandidateVoteHistory',
+			params: 2
+		}),
+		new web3._extend.Method({
+			name: 'getSnapshotProvenance',
+			call: 'XDPoS_getSnapshotProvenance',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'getSnapshotJSON',
+			call: 'XDPoS_getSnapshotJSON',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'getMintingSchedule',
+			call: 'XDPoS_getMintingSchedule',
+			params: 2,
+			inputFormatter: [null, web3._extend.formatters.inputAddressFormatter]
+		}),
+		new web3._extend.Method({
+			name: 'attestMasternodeSet',
+			call: 'XDPoS_attestMasternodeSet',
+			params: 0
+		}),
 	],
 	properties: [
 		new web3._extend.Property({
@@ -151,6 +151,10 @@ type XDPoSConfig struct {
 	RewardCheckpoint    uint64         `json:"rewardCheckpoint"`    // Checkpoint block for calculate rewards.
 	Gap                 uint64         `json:"gap"`                 // Gap time preparing for the next epoch
 	FoudationWalletAddr common.Address `json:"foudationWalletAddr"` // Foundation Address Wallet
+	RecentSignerLimit   uint64         `json:"recentSignerLimit"`   // Number of consecutive blocks a masternode may sign only one of (0 = 2)
+
+	CheckpointValidatorsBlock *big.Int `json:"checkpointValidatorsBlock,omitempty"` // Checkpoints must carry validators from this block (nil = no fork)
+	ShuffleMasternodesBlock   *big.Int `json:"shuffleMasternodesBlock,omitempty"`   // Checkpoints list the masternodes shuffled from this block (nil = no fork)
 }
 
 // String implements the stringer interface, returning the consensus engine details.
@@ -231,6 +235,18 @@ func (c *ChainConfig) IsTIPIncreaseMasternodes(num *big.Int) bool {
 	return isForked(common.TIPIncreaseMasternodes, num)
 }
 
+// IsCheckpointValidators returns whether XDPoS checkpoints past the first epoch
+// must carry a validator for each of their masternodes at num.
+func (c *ChainConfig) IsCheckpointValidators(num *big.Int) bool {
+	return c.XDPoS != nil && isForked(c.XDPoS.CheckpointValidatorsBlock, num)
+}
+
+// IsShuffleMasternodes returns whether XDPoS checkpoints list their masternodes
+// in the order shuffled with the parent hash as seed at num.
+func (c *ChainConfig) IsShuffleMasternodes(num *big.Int) bool {
+	return c.XDPoS != nil && isForked(c.XDPoS.ShuffleMasternodesBlock, num)
+}
+
 // GasTable returns the gas table corresponding to the current phase (homestead or homestead reprice).
 //
 // The returned GasTable's fields shouldn't, under any circumstances, be changed.
@@ -294,6 +310,12 @@ func (c *ChainConfig) checkCompatible(newcfg *ChainConfig, head *big.Int) *Confi
 	if isForkIncompatible(c.ConstantinopleBlock, newcfg.ConstantinopleBlock, head) {
 		return newCompatError("Constantinople fork block", c.ConstantinopleBlock, newcfg.ConstantinopleBlock)
 	}
+	if c.XDPoS != nil && newcfg.XDPoS != nil && isForkIncompatible(c.XDPoS.CheckpointValidatorsBlock, newcfg.XDPoS.CheckpointValidatorsBlock, head) {
+		return newCompatError("XDPoS checkpoint validators fork block", c.XDPoS.CheckpointValidatorsBlock, newcfg.XDPoS.CheckpointValidatorsBlock)
+	}
+	if c.XDPoS != nil && newcfg.XDPoS != nil && isForkIncompatible(c.XDPoS.ShuffleMasternodesBlock, newcfg.XDPoS.ShuffleMasternodesBlock, head) {
+		return newCompatError("XDPoS shuffle masternodes fork block", c.XDPoS.ShuffleMasternodesBlock, newcfg.XDPoS.ShuffleMasternodesBlock)
+	}
 	return nil
 }
 
@@ -70,6 +70,34 @@ func TestCheckCompatible(t *testing.T) {
 				RewindTo:     9,
 			},
 		},
+		{
+			stored: &ChainConfig{XDPoS: &XDPoSConfig{CheckpointValidatorsBlock: big.NewInt(900)}},
+			new:    &ChainConfig{XDPoS: &XDPoSConfig{CheckpointValidatorsBlock: big.NewInt(1800)}},
+			head:   1000,
+			wantErr: &ConfigCompatError{
+				What:         "XDPoS checkpoint validators fork block",
+				StoredConfig: big.NewInt(900),
+				NewConfig:    big.NewInt(1800),
+				RewindTo:     899,
+			},
+		},
+		{
+			stored:  &ChainConfig{XDPoS: &XDPoSConfig{ShuffleMasternodesBlock: big.NewInt(900)}},
+			new:     &ChainConfig{XDPoS: &XDPoSConfig{ShuffleMasternodesBlock: big.NewInt(1800)}},
+			head:    800,
+			wantErr: nil,
+		},
+		{
+			stored: &ChainConfig{XDPoS: &XDPoSConfig{ShuffleMasternodesBlock: big.NewInt(900)}},
+			new:    &ChainConfig{XDPoS: &XDPoSConfig{}},
+			head:   1000,
+			wantErr: &ConfigCompatError{
+				What:         "XDPoS shuffle masternodes fork block",
+				StoredConfig: big.NewInt(900),
+				NewConfig:    nil,
+				RewindTo:     899,
+			},
+		},
 	}
 
 	for _, test := range tests {